@@ -9,16 +9,19 @@ import (
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	if len(port) == 0 {
-		port = "3000"
+	// Outside Cloud Foundry the configuration comes from the config file,
+	// the environment and flags alone
+	appEnv, err := cfenv.Current()
+	if err != nil {
+		fmt.Printf("Not running in Cloud Foundry (%v); continuing without service bindings\n", err)
+		appEnv = nil
 	}
 
-	appEnv, err := cfenv.Current()
+	settings, err := server.LoadSettings(appEnv, os.Args[1:])
 	if err != nil {
-		fmt.Printf("FATAL: Could not retrieve CF environment: %v", err)
+		fmt.Printf("FATAL: Could not load configuration: %v\n", err)
 		os.Exit(1)
 	}
-	s := server.NewServer(appEnv)
-	s.Run(":" + port)
+	s := server.NewServer(settings)
+	s.Run(":" + settings.Get("PORT"))
 }
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+)
+
+const bearerRealm = "oauth-authcode"
+
+type contextKey int
+
+// claimsKey holds the validated token claims in the request context.
+const claimsKey contextKey = 0
+
+// bearerError is an RFC 6750 section 3.1 error response.
+type bearerError struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error,omitempty"`
+	Description string `json:"error_description,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// requireBearer protects JSON APIs: the request must carry a valid access
+// token in the Authorization header that satisfies the access policy. The
+// token's claims are available to handlers through claimsFromRequest.
+func requireBearer(config *authConfig) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		raw, berr := bearerToken(r)
+		if berr != nil {
+			writeBearerError(w, berr)
+			return
+		}
+
+		token, err := parseToken(raw, config.forBearer(raw))
+		if err == nil {
+			err = checkCertificateBinding(token, r, config)
+		}
+		if err != nil {
+			fmt.Printf("Rejected bearer token: %s\n", err)
+			writeBearerError(w, &bearerError{Status: http.StatusUnauthorized, Code: "invalid_token", Description: err.Error()})
+			return
+		}
+
+		rule := config.Policy.rule(r.Method, r.URL.Path)
+		if rule == nil && config.Policy.Default != "allow" {
+			writeBearerError(w, &bearerError{Status: http.StatusForbidden, Code: "insufficient_scope", Description: "no access policy rule allows this request"})
+			return
+		}
+		if rule != nil && !rule.allows(token) {
+			writeBearerError(w, &bearerError{
+				Status:      http.StatusForbidden,
+				Code:        "insufficient_scope",
+				Description: "the access token lacks the scope this resource requires",
+				Scope:       strings.Join(rule.Scopes, " "),
+			})
+			return
+		}
+
+		context.Set(r, claimsKey, token.Claims)
+		next(w, r)
+	}
+}
+
+// bearerToken extracts the token from the Authorization header. A missing
+// header yields a challenge without an error code, as RFC 6750 requires.
+func bearerToken(r *http.Request) (string, *bearerError) {
+	header := r.Header.Get("Authorization")
+	if len(header) == 0 {
+		return "", &bearerError{Status: http.StatusUnauthorized}
+	}
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || len(strings.TrimSpace(parts[1])) == 0 {
+		return "", &bearerError{Status: http.StatusBadRequest, Code: "invalid_request", Description: "expected an Authorization: Bearer header"}
+	}
+	return strings.TrimSpace(parts[1]), nil
+}
+
+func writeBearerError(w http.ResponseWriter, e *bearerError) {
+	challenge := fmt.Sprintf("Bearer realm=%q", bearerRealm)
+	if len(e.Code) > 0 {
+		challenge += fmt.Sprintf(", error=%q", e.Code)
+	}
+	if len(e.Description) > 0 {
+		challenge += fmt.Sprintf(", error_description=%q", strings.Replace(e.Description, `"`, `'`, -1))
+	}
+	if len(e.Scope) > 0 {
+		challenge += fmt.Sprintf(", scope=%q", e.Scope)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	if len(e.Code) > 0 {
+		json.NewEncoder(w).Encode(e)
+	}
+}
+
+// claimsFromRequest returns the claims stored by requireBearer.
+func claimsFromRequest(r *http.Request) map[string]interface{} {
+	claims, _ := context.Get(r, claimsKey).(map[string]interface{})
+	return claims
+}
+
+// apiUserHandler returns the caller's token claims as JSON.
+func apiUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(claimsFromRequest(r))
+	}
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +8,7 @@ import (
 	"net/http"
 
 	"github.com/astaxie/beego/session"
+	"github.com/gorilla/mux"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 )
@@ -17,21 +17,45 @@ func callbackHandler(sessionManager *session.Manager, config *authConfig) http.H
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		// set context with http client configured to skipSSL
-		ctx := getContext(true)
+		// Additional identity providers call back on /callback/<name>
+		config := config
+		if name, ok := mux.Vars(r)["provider"]; ok {
+			p, found := config.Providers.get(name)
+			if !found || p == config {
+				errorPage(w, http.StatusNotFound, "Login Failed", "Unknown identity provider.")
+				return
+			}
+			config = p
+		}
 
-		// Instantiating the OAuth2 package to exchange the Code for a Token
-		conf := &oauth2.Config{
-			ClientID:     config.ClientID,
-			ClientSecret: config.ClientSecret,
-			RedirectURL:  config.CallbackURL,
-			Scopes:       []string{"openid", "test.access", "test.admin"},
-			Endpoint: oauth2.Endpoint{
-				AuthURL:  config.Domain + "/oauth/authorize",
-				TokenURL: config.Domain + "/oauth/token",
-			},
+		session, err := startSession(sessionManager, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
+		// The state must match a login started from this browser session. The
+		// attempt is consumed right away so the same response cannot be replayed.
+		attempt, err := takeLoginAttempt(session, r.URL.Query().Get("state"))
+		releaseSession(w, session)
+		if err != nil {
+			fmt.Printf("Rejected callback: %s\n", err)
+			errorPage(w, http.StatusBadRequest, "Login Failed", err.Error())
+			return
+		}
+		// A response for a login started with another provider is a mix-up attempt
+		if attempt.Provider != config.Name {
+			fmt.Printf("Rejected callback: login was started with %q, not %q\n", attempt.Provider, config.Name)
+			errorPage(w, http.StatusBadRequest, "Login Failed", "The login response came from a different identity provider.")
+			return
+		}
+
+		// set context with the shared outbound http client
+		ctx := config.context()
+
+		// Instantiating the OAuth2 package to exchange the Code for a Token
+		conf := config.oauthConfig()
+
 		// Getting the Code that we got from Auth0
 		e := r.URL.Query().Get("error")
 		if len(e) > 0 {
@@ -47,62 +71,92 @@ func callbackHandler(sessionManager *session.Manager, config *authConfig) http.H
 			return
 		}
 
-		// Exchanging the code for a token
-		token, err := conf.Exchange(ctx, code)
+		// Exchanging the code (and PKCE verifier) for a token
+		token, err := exchangeCode(ctx, config, code, attempt.Verifier)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Getting now the User information
-		client := conf.Client(ctx, token)
-		resp, err := client.Get(config.Domain + "/userinfo")
+		// The ID token is the authoritative identity of the user
+		rawIDToken, _ := token.Extra("id_token").(string)
+		idToken, err := validateIDToken(rawIDToken, token.AccessToken, attempt.Nonce, config)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fmt.Printf("Rejected ID token: %s\n", err)
+			errorPage(w, http.StatusUnauthorized, "Login Failed", err.Error())
 			return
 		}
-
-		// Reading the body
-		raw, err := ioutil.ReadAll(resp.Body)
-		defer resp.Body.Close()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		profile := profileFromClaims(idToken.Claims)
+
+		// Optionally enrich the profile with the userinfo endpoint
+		if config.UserInfo && len(config.endpoints().UserInfo) > 0 {
+			userInfo, err := fetchUserInfo(ctx, conf, token, config)
+			if err != nil {
+				fmt.Printf("Error retrieving userinfo: %s\n", err)
+			} else if userInfo["sub"] != profile["sub"] {
+				fmt.Printf("Ignoring userinfo for subject %v, expected %v\n", userInfo["sub"], profile["sub"])
+			} else {
+				for k, v := range userInfo {
+					if _, ok := profile[k]; !ok {
+						profile[k] = v
+					}
+				}
+			}
 		}
 
-		// Unmarshalling the JSON of the Profile
-		var profile map[string]interface{}
-		if err := json.Unmarshal(raw, &profile); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		// A new session id after login defeats session fixation
+		session = regenerateSession(sessionManager, w, r, session)
 
 		// Saving the information to the session.
-		session, _ := sessionManager.SessionStart(w, r)
-		defer session.SessionRelease(w)
-
 		jsonToken, err := tokenToJSON(token)
 		if err != nil {
 			fmt.Println("ERROR MARHSALING TOKEN TO JSON!")
 		}
 		session.Set("token", jsonToken)
+		session.Set("id_token", rawIDToken)
 		session.Set("profile", profile)
+		session.Set("provider", config.Name)
 
-		// Redirect to logged in page
-		http.Redirect(w, r, "/protected/user", http.StatusMovedPermanently)
+		// Release before redirecting so cookie-backed sessions can still set their cookie
+		if err := releaseSession(w, session); err != nil {
+			fmt.Printf("Could not save session: %s\n", err)
+			errorPage(w, http.StatusInternalServerError, "Login Failed", err.Error())
+			return
+		}
+		config.SessionIndex.add(session.SessionID(), profile)
+
+		// Redirect to the page the login was started for, or the logged in page
+		returnTo := "/protected/user"
+		if _, ok := config.safeReturnTo(attempt.ReturnTo); ok {
+			returnTo = attempt.ReturnTo
+		}
+		config.redirect(w, r, returnTo)
 
 	}
 }
 
-func getContext(skipSSL bool) (ctx context.Context) {
-	ctx = oauth2.NoContext
-	if !skipSSL {
-		return
+// fetchUserInfo retrieves the claims served by the userinfo endpoint.
+func fetchUserInfo(ctx context.Context, conf *oauth2.Config, token *oauth2.Token, config *authConfig) (map[string]interface{}, error) {
+	client := conf.Client(ctx, token)
+	resp, err := client.Get(config.endpoints().UserInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo returned %s", resp.Status)
+	}
+
+	// Reading the body
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	// Unmarshalling the JSON of the Profile
+	var userInfo map[string]interface{}
+	if err := json.Unmarshal(raw, &userInfo); err != nil {
+		return nil, err
 	}
-	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: tr})
-	return
+	return userInfo, nil
 }
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/session"
+)
+
+// startTestLogin stores a login attempt for the default provider in a new
+// session and returns the cookie carrying it.
+func startTestLogin(t *testing.T, sm *session.Manager) *http.Cookie {
+	w := httptest.NewRecorder()
+	sess, err := sm.SessionStart(w, httptest.NewRequest("GET", "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveLoginAttempt(sess, &loginAttempt{State: "state-1", Nonce: "nonce-1", Provider: defaultProviderName, Created: time.Now()})
+	sess.SessionRelease(w)
+	return sessionCookie(t, w)
+}
+
+// newCallbackConfig returns a config whose token endpoint issues a valid ID
+// token along with tokens derived from refresh.
+func newCallbackConfig(t *testing.T, refresh string) (*authConfig, *httptest.Server) {
+	config := newTestConfig()
+	config.SessionIndex = newMemorySessionIndex(time.Hour)
+	ts := newTokenServer(config, func(w http.ResponseWriter, r *http.Request) {
+		writeTokenResponse(w, refresh, signTestToken(t, idTokenClaims(), nil, nil))
+	})
+	return config, ts
+}
+
+func TestCallbackRegeneratesSessionID(t *testing.T) {
+	config, ts := newCallbackConfig(t, "r1")
+	defer ts.Close()
+	sm := newTestSessionManager(t)
+	planted := startTestLogin(t, sm)
+
+	r := httptest.NewRequest("GET", "/callback?state=state-1&code=code-1", nil)
+	r.AddCookie(planted)
+	w := httptest.NewRecorder()
+	callbackHandler(sm, config)(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	issued := sessionCookie(t, w)
+	if issued.Value == planted.Value {
+		t.Fatal("the session id was not changed at login")
+	}
+	sess, _ := sm.GetSessionStore(planted.Value)
+	if sess.Get("token") != nil {
+		t.Error("the planted session id was logged in")
+	}
+	sess, _ = sm.GetSessionStore(issued.Value)
+	if _, ok := sess.Get("token").(string); !ok {
+		t.Error("the new session holds no token")
+	}
+	if sids, _ := config.SessionIndex.sessions("user-1"); len(sids) != 1 || sids[0] != issued.Value {
+		t.Errorf("indexed sessions %v, want %s", sids, issued.Value)
+	}
+}
+
+func TestCallbackWithCookieSessions(t *testing.T) {
+	sm, err := newSessionManager(&sessionConfig{Provider: "cookie", Lifetime: 3600, HashKey: "test-hash-key", BlockKey: "0123456789abcdef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		refresh string
+		status  int
+	}{
+		{"small tokens", "r1", http.StatusFound},
+		{"tokens too large for a cookie", strings.Repeat("r", 3000), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		config, ts := newCallbackConfig(t, tt.refresh)
+		r := httptest.NewRequest("GET", "/callback?state=state-1&code=code-1", nil)
+		r.AddCookie(startTestLogin(t, sm))
+		w := httptest.NewRecorder()
+		callbackHandler(sm, config)(w, r)
+		ts.Close()
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+			continue
+		}
+		for _, c := range w.Result().Cookies() {
+			if len(c.String()) > maxCookieSize {
+				t.Errorf("%s: set a %d byte cookie", tt.name, len(c.String()))
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Client authentication methods, as named in the provider metadata.
+const (
+	clientSecretBasic = "client_secret_basic"
+	clientSecretPost  = "client_secret_post"
+	clientSecretJWT   = "client_secret_jwt"
+	privateKeyJWT     = "private_key_jwt"
+	// tlsClientAuth authenticates with the outbound client certificate (RFC 8705)
+	tlsClientAuth = "tls_client_auth"
+
+	jwtBearerAssertion = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	assertionLifetime  = time.Minute
+)
+
+// clientAuthenticator adds the app's client credentials to a form post to one
+// of the provider's endpoints: token, revocation or introspection.
+type clientAuthenticator interface {
+	// Authenticate sets headers on req or parameters in form, the request body.
+	// audience is the provider's token endpoint, used by signed assertions.
+	Authenticate(req *http.Request, form url.Values, audience string) error
+}
+
+// secretBasicAuth sends the secret in the Authorization header.
+type secretBasicAuth struct {
+	clientID, secret string
+}
+
+func (a *secretBasicAuth) Authenticate(req *http.Request, form url.Values, audience string) error {
+	req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.secret))
+	return nil
+}
+
+// secretPostAuth sends the secret in the request body.
+type secretPostAuth struct {
+	clientID, secret string
+}
+
+func (a *secretPostAuth) Authenticate(req *http.Request, form url.Values, audience string) error {
+	form.Set("client_id", a.clientID)
+	form.Set("client_secret", a.secret)
+	return nil
+}
+
+// tlsAuth relies on the client certificate presented by the outbound client.
+type tlsAuth struct {
+	clientID string
+}
+
+func (a *tlsAuth) Authenticate(req *http.Request, form url.Values, audience string) error {
+	form.Set("client_id", a.clientID)
+	return nil
+}
+
+// assertionAuth sends a short-lived JWT signed with the client secret
+// (client_secret_jwt) or the client's private key (private_key_jwt), as
+// described in RFC 7523 and OpenID Connect Core section 9.
+type assertionAuth struct {
+	clientID string
+	method   jwt.SigningMethod
+	key      interface{}
+	keyID    string
+}
+
+func (a *assertionAuth) Authenticate(req *http.Request, form url.Values, audience string) error {
+	jti, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	t := jwt.New(a.method)
+	if len(a.keyID) > 0 {
+		t.Header["kid"] = a.keyID
+	}
+	t.Claims["iss"] = a.clientID
+	t.Claims["sub"] = a.clientID
+	t.Claims["aud"] = audience
+	t.Claims["jti"] = jti
+	t.Claims["iat"] = now.Unix()
+	t.Claims["exp"] = now.Add(assertionLifetime).Unix()
+	assertion, err := t.SignedString(a.key)
+	if err != nil {
+		return fmt.Errorf("cannot sign client assertion: %s", err)
+	}
+	form.Set("client_id", a.clientID)
+	form.Set("client_assertion_type", jwtBearerAssertion)
+	form.Set("client_assertion", assertion)
+	return nil
+}
+
+// clientAuthFromEnv builds the authenticator named by CLIENT_AUTH_METHOD.
+// private_key_jwt reads a PEM key from CLIENT_PRIVATE_KEY_FILE or
+// SSO_PRIVATE_KEY (the sso service's private_key credential), signs with
+// CLIENT_SIGNING_ALG (RS256 or ES256 by default, following the key) and names
+// the key CLIENT_KEY_ID.
+func clientAuthFromEnv(settings *Settings, config *authConfig) (string, clientAuthenticator, error) {
+	setting := settings.Get("CLIENT_AUTH_METHOD")
+	method := strings.ToLower(setting)
+	switch method {
+	case "", clientSecretBasic, clientSecretPost:
+		if len(config.ClientSecret) == 0 {
+			return "", nil, errors.New("SSO_CLIENT_SECRET is not set; provide the client_secret of the sso service binding, or set CLIENT_AUTH_METHOD to private_key_jwt or tls_client_auth")
+		}
+		if method == clientSecretPost {
+			return method, &secretPostAuth{config.ClientID, config.ClientSecret}, nil
+		}
+		return clientSecretBasic, &secretBasicAuth{config.ClientID, config.ClientSecret}, nil
+	case tlsClientAuth:
+		if !hasClientCertificate(config.HTTPClient) {
+			return "", nil, errors.New("CLIENT_AUTH_METHOD tls_client_auth requires TLS_CLIENT_CERT_FILE and TLS_CLIENT_KEY_FILE.")
+		}
+		return method, &tlsAuth{config.ClientID}, nil
+	case clientSecretJWT:
+		alg := settings.Get("CLIENT_SIGNING_ALG")
+		if len(alg) == 0 {
+			alg = "HS256"
+		}
+		signing, ok := jwt.GetSigningMethod(alg).(*jwt.SigningMethodHMAC)
+		if !ok {
+			return "", nil, fmt.Errorf("client_secret_jwt needs an HMAC CLIENT_SIGNING_ALG, not %q", alg)
+		}
+		if len(config.ClientSecret) == 0 {
+			return "", nil, errors.New("client_secret_jwt requires a client secret.")
+		}
+		return method, &assertionAuth{clientID: config.ClientID, method: signing, key: []byte(config.ClientSecret)}, nil
+	case privateKeyJWT:
+		auth, err := privateKeyAuth(settings, config.ClientID)
+		if err != nil {
+			return "", nil, err
+		}
+		return method, auth, nil
+	}
+	return "", nil, invalidSetting(settings, "CLIENT_AUTH_METHOD", setting, "client_secret_basic, client_secret_post, client_secret_jwt, private_key_jwt or tls_client_auth")
+}
+
+func privateKeyAuth(settings *Settings, clientID string) (*assertionAuth, error) {
+	var pem []byte
+	if file := settings.Get("CLIENT_PRIVATE_KEY_FILE"); len(file) > 0 {
+		var err error
+		if pem, err = ioutil.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("Could not read CLIENT_PRIVATE_KEY_FILE: %s", err)
+		}
+	} else {
+		pem = []byte(settings.Get("SSO_PRIVATE_KEY"))
+	}
+	if len(pem) == 0 {
+		return nil, errors.New("private_key_jwt requires CLIENT_PRIVATE_KEY_FILE or SSO_PRIVATE_KEY.")
+	}
+
+	auth := &assertionAuth{clientID: clientID, keyID: settings.Get("CLIENT_KEY_ID")}
+	alg := settings.Get("CLIENT_SIGNING_ALG")
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(pem); err == nil {
+		auth.key = key
+		if len(alg) == 0 {
+			alg = "RS256"
+		}
+		if _, ok := jwt.GetSigningMethod(alg).(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("CLIENT_SIGNING_ALG %q does not fit an RSA key", alg)
+		}
+	} else if key, err := jwt.ParseECPrivateKeyFromPEM(pem); err == nil {
+		auth.key = key
+		if len(alg) == 0 {
+			alg = "ES256"
+		}
+		m, ok := jwt.GetSigningMethod(alg).(*jwt.SigningMethodECDSA)
+		if !ok || m.CurveBits != key.Curve.Params().BitSize {
+			return nil, fmt.Errorf("CLIENT_SIGNING_ALG %q does not fit the EC key", alg)
+		}
+	} else {
+		return nil, errors.New("The client private key is not a PEM encoded RSA or EC key.")
+	}
+	auth.method = jwt.GetSigningMethod(alg)
+	return auth, nil
+}
+
+// newFormRequest builds an authenticated form post to one of the provider's
+// endpoints.
+func (ac *authConfig) newFormRequest(endpoint string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequest("POST", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := ac.clientAuth.Authenticate(req, form, ac.endpoints().Token); err != nil {
+		return nil, err
+	}
+	body := form.Encode()
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestPrivateKeyAssertion(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testSigningKey)}))
+	ecFile := writeTestFile(t, "client.key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})))
+
+	tests := []struct {
+		name   string
+		values map[string]string
+		alg    string
+		public interface{}
+	}{
+		{"rsa", map[string]string{"SSO_PRIVATE_KEY": rsaPEM, "CLIENT_KEY_ID": "key-1"}, "RS256", &testSigningKey.PublicKey},
+		{"rsa rs512", map[string]string{"SSO_PRIVATE_KEY": rsaPEM, "CLIENT_SIGNING_ALG": "RS512"}, "RS512", &testSigningKey.PublicKey},
+		{"ec file", map[string]string{"CLIENT_PRIVATE_KEY_FILE": ecFile, "CLIENT_KEY_ID": "key-2"}, "ES256", &ecKey.PublicKey},
+	}
+	const audience = "https://login.example.com/oauth/token"
+	for _, tt := range tests {
+		auth, err := privateKeyAuth(newTestSettings(tt.values), testClientID)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		jtis := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			form := url.Values{}
+			req, _ := http.NewRequest("POST", audience, nil)
+			if err := auth.Authenticate(req, form, audience); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if form.Get("client_id") != testClientID || form.Get("client_assertion_type") != jwtBearerAssertion || len(req.Header.Get("Authorization")) > 0 {
+				t.Fatalf("%s: form %v", tt.name, form)
+			}
+
+			token, err := jwt.Parse(form.Get("client_assertion"), func(token *jwt.Token) (interface{}, error) {
+				if token.Method.Alg() != tt.alg {
+					t.Errorf("%s: signed with %s, want %s", tt.name, token.Method.Alg(), tt.alg)
+				}
+				return tt.public, nil
+			})
+			if err != nil || !token.Valid {
+				t.Fatalf("%s: assertion does not verify: %v", tt.name, err)
+			}
+			if kid, _ := token.Header["kid"].(string); kid != tt.values["CLIENT_KEY_ID"] {
+				t.Errorf("%s: kid %q, want %q", tt.name, kid, tt.values["CLIENT_KEY_ID"])
+			}
+			claims := token.Claims
+			if claims["iss"] != testClientID || claims["sub"] != testClientID || claims["aud"] != audience {
+				t.Errorf("%s: claims %v", tt.name, claims)
+			}
+			iat, _ := claims["iat"].(float64)
+			exp, _ := claims["exp"].(float64)
+			if now := float64(time.Now().Unix()); iat > now || iat < now-5 || exp-iat != assertionLifetime.Seconds() {
+				t.Errorf("%s: iat %v, exp %v", tt.name, iat, exp)
+			}
+			jti, _ := claims["jti"].(string)
+			if len(jti) == 0 || jtis[jti] {
+				t.Errorf("%s: jti %q is missing or reused", tt.name, jti)
+			}
+			jtis[jti] = true
+		}
+	}
+}
+
+func TestPrivateKeyAuthErrors(t *testing.T) {
+	rsaPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testSigningKey)}))
+	tests := []struct {
+		values map[string]string
+		err    string
+	}{
+		{map[string]string{}, "requires CLIENT_PRIVATE_KEY_FILE or SSO_PRIVATE_KEY"},
+		{map[string]string{"CLIENT_PRIVATE_KEY_FILE": "/nonexistent/client.key"}, "Could not read CLIENT_PRIVATE_KEY_FILE"},
+		{map[string]string{"SSO_PRIVATE_KEY": "not a key"}, "not a PEM encoded RSA or EC key"},
+		{map[string]string{"SSO_PRIVATE_KEY": rsaPEM, "CLIENT_SIGNING_ALG": "ES256"}, "does not fit an RSA key"},
+		{map[string]string{"SSO_PRIVATE_KEY": rsaPEM, "CLIENT_SIGNING_ALG": "HS256"}, "does not fit an RSA key"},
+	}
+	for _, tt := range tests {
+		if _, err := privateKeyAuth(newTestSettings(tt.values), testClientID); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: error = %v, want %q", tt.values, err, tt.err)
+		}
+	}
+}
+
+func TestClientAuthSecret(t *testing.T) {
+	certFile, keyFile := writeTestKeyPair(t, "client")
+	certClient, err := newHTTPClient(&outboundTLS{CertFile: certFile, KeyFile: keyFile, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testSigningKey)}))
+	tests := []struct {
+		values map[string]string
+		secret string
+		method string
+		err    string
+	}{
+		{map[string]string{}, "", "", "SSO_CLIENT_SECRET is not set"},
+		{map[string]string{}, "secret", clientSecretBasic, ""},
+		{map[string]string{"CLIENT_AUTH_METHOD": "client_secret_basic"}, "", "", "SSO_CLIENT_SECRET is not set"},
+		{map[string]string{"CLIENT_AUTH_METHOD": "Client_Secret_Post"}, "", "", "SSO_CLIENT_SECRET is not set"},
+		{map[string]string{"CLIENT_AUTH_METHOD": "client_secret_post"}, "secret", clientSecretPost, ""},
+		{map[string]string{"CLIENT_AUTH_METHOD": "client_secret_jwt"}, "", "", "requires a client secret"},
+		{map[string]string{"CLIENT_AUTH_METHOD": "private_key_jwt", "SSO_PRIVATE_KEY": rsaPEM}, "", privateKeyJWT, ""},
+		{map[string]string{"CLIENT_AUTH_METHOD": "tls_client_auth"}, "", tlsClientAuth, ""},
+		{map[string]string{"CLIENT_AUTH_METHOD": "basic"}, "secret", "", `CLIENT_AUTH_METHOD "basic" from test is invalid`},
+	}
+	for _, tt := range tests {
+		config := &authConfig{ClientID: testClientID, ClientSecret: tt.secret, HTTPClient: certClient}
+		method, _, err := clientAuthFromEnv(newTestSettings(tt.values), config)
+		if method != tt.method || !matchesError(err, tt.err) {
+			t.Errorf("%v with secret %q: got %q, %v; want %q, %q", tt.values, tt.secret, method, err, tt.method, tt.err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// clientCredentialsSource obtains the app's own access token with the
+// client_credentials grant and reuses it until it is about to expire.
+type clientCredentialsSource struct {
+	config *authConfig
+	scopes []string
+	lock   sync.Mutex
+	token  *oauth2.Token
+}
+
+// Token implements oauth2.TokenSource.
+func (s *clientCredentialsSource) Token() (*oauth2.Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.token != nil && !needsRefresh(s.token, s.config.RefreshMargin) {
+		return s.token, nil
+	}
+	v := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.scopes) > 0 {
+		v.Set("scope", strings.Join(s.scopes, " "))
+	}
+	token, err := retrieveToken(s.config.context(), s.config, v)
+	if err != nil {
+		fmt.Printf("Error obtaining client credentials token: %s\n", err)
+		return nil, err
+	}
+	s.token = token
+	return token, nil
+}
+
+// clientCredentials caches one token source per requested scope set.
+type clientCredentials struct {
+	// Scopes are requested when the caller asks for no particular scopes
+	Scopes  []string
+	lock    sync.Mutex
+	sources map[string]*clientCredentialsSource
+}
+
+// clientCredentialsFromEnv reads CLIENT_CREDENTIALS_SCOPES, a comma separated
+// list of scopes requested for the app's own token.
+func clientCredentialsFromEnv(settings *Settings) *clientCredentials {
+	return &clientCredentials{
+		Scopes:  splitList(settings.Get("CLIENT_CREDENTIALS_SCOPES")),
+		sources: make(map[string]*clientCredentialsSource),
+	}
+}
+
+// serviceTokenSource returns the cached token source for scopes, or for the
+// configured default scopes when none are given.
+func (ac *authConfig) serviceTokenSource(scopes ...string) oauth2.TokenSource {
+	cc := ac.ClientCredentials
+	if len(scopes) == 0 {
+		scopes = cc.Scopes
+	}
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, " ")
+
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	source, ok := cc.sources[key]
+	if !ok {
+		source = &clientCredentialsSource{config: ac, scopes: sorted}
+		cc.sources[key] = source
+	}
+	return source
+}
+
+// serviceClient returns an http.Client that authenticates every request with
+// the app's own client credentials token.
+func (ac *authConfig) serviceClient(scopes ...string) *http.Client {
+	return &http.Client{
+		Transport: &oauth2.Transport{Source: ac.serviceTokenSource(scopes...), Base: ac.HTTPClient.Transport},
+		Timeout:   ac.HTTPClient.Timeout,
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// newClientCredentialsServer issues cc-1, cc-2, ... and records the scopes requested.
+func newClientCredentialsServer(t *testing.T, config *authConfig, scopes *[]string) *httptest.Server {
+	issued := 0
+	return newTokenServer(config, func(w http.ResponseWriter, r *http.Request) {
+		if grant := r.PostFormValue("grant_type"); grant != "client_credentials" {
+			t.Errorf("grant_type = %q", grant)
+		}
+		issued++
+		*scopes = append(*scopes, r.PostFormValue("scope"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"cc-%d","token_type":"bearer","expires_in":3600}`, issued)
+	})
+}
+
+func TestServiceTokenSource(t *testing.T) {
+	config := newTestConfig()
+	config.ClientCredentials = clientCredentialsFromEnv(newTestSettings(map[string]string{"CLIENT_CREDENTIALS_SCOPES": "uaa.resource,backing.read"}))
+	var scopes []string
+	ts := newClientCredentialsServer(t, config, &scopes)
+	defer ts.Close()
+
+	token := func(scopes ...string) string {
+		tok, err := config.serviceTokenSource(scopes...).Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok.AccessToken
+	}
+	if a, b := token(), token(); a != "cc-1" || b != "cc-1" {
+		t.Fatalf("tokens %s, %s; want the cached cc-1", a, b)
+	}
+	if a, b := token("b", "a"), token("a", "b"); a != "cc-2" || b != "cc-2" {
+		t.Fatalf("tokens %s, %s; want one token per scope set", a, b)
+	}
+	if want := []string{"backing.read uaa.resource", "a b"}; fmt.Sprint(scopes) != fmt.Sprint(want) {
+		t.Fatalf("requested scopes %q, want %q", scopes, want)
+	}
+
+	// A token about to expire is replaced before it is used
+	source := config.serviceTokenSource().(*clientCredentialsSource)
+	source.token.Expiry = time.Now().Add(config.RefreshMargin / 2)
+	if a := token(); a != "cc-3" {
+		t.Fatalf("token near expiry: got %s, want cc-3", a)
+	}
+	if a := token(); a != "cc-3" {
+		t.Fatalf("got %s after renewal, want cc-3", a)
+	}
+}
+
+func TestServiceClient(t *testing.T) {
+	config := newTestConfig()
+	config.ClientCredentials = clientCredentialsFromEnv(newTestSettings(nil))
+	var scopes []string
+	ts := newClientCredentialsServer(t, config, &scopes)
+	defer ts.Close()
+	var authorization []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	client := config.serviceClient()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if fmt.Sprint(authorization) != "[Bearer cc-1 Bearer cc-1]" || len(scopes) != 1 {
+		t.Fatalf("upstream got %q after %d token requests", authorization, len(scopes))
+	}
+}
+
+func TestClientCredentialsServiceStrategy(t *testing.T) {
+	config := newTestConfig()
+	config.ClientCredentials = clientCredentialsFromEnv(newTestSettings(nil))
+	var scopes []string
+	ts := newClientCredentialsServer(t, config, &scopes)
+	defer ts.Close()
+	var authorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	svc := &backingService{Name: "reports", URL: upstream.URL, Timeout: defaultServiceTimeout, Strategy: strategyClient}
+	req, _ := http.NewRequest("GET", "", nil)
+	req.URL.Path = "/api/reports"
+	resp, err := svc.do(config, &oauth2.Token{AccessToken: "user-token"}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if authorization != "Bearer cc-1" {
+		t.Fatalf("service got Authorization %q, want the app's own token", authorization)
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wellKnownPath           = "/.well-known/openid-configuration"
+	defaultDiscoveryRefresh = time.Hour
+)
+
+// providerEndpoints are the IdP URLs used by the app. Endpoints the provider
+// does not offer are left empty.
+type providerEndpoints struct {
+	Issuer        string `json:"issuer"`
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	UserInfo      string `json:"userinfo_endpoint"`
+	JWKS          string `json:"jwks_uri"`
+	EndSession    string `json:"end_session_endpoint"`
+	Revocation    string `json:"revocation_endpoint"`
+	Introspection string `json:"introspection_endpoint"`
+	// MTLSAliases are the endpoints to use with mutual TLS (RFC 8705)
+	MTLSAliases *providerEndpoints `json:"mtls_endpoint_aliases,omitempty"`
+}
+
+// uaaEndpoints returns the endpoints of a UAA server at domain.
+func uaaEndpoints(domain string, issuer string) *providerEndpoints {
+	return &providerEndpoints{
+		Issuer:        issuer,
+		Authorization: domain + "/oauth/authorize",
+		Token:         domain + "/oauth/token",
+		UserInfo:      domain + "/userinfo",
+		JWKS:          domain + "/token_keys",
+		EndSession:    domain + "/logout.do",
+		Revocation:    domain + "/oauth/token/revoke",
+		Introspection: domain + "/introspect",
+	}
+}
+
+// providerDiscovery caches the provider metadata document and reloads it once
+// it is older than refresh. If a reload fails the previous endpoints are kept.
+type providerDiscovery struct {
+	URL       string
+	Issuer    string
+	Refresh   time.Duration
+	client    *http.Client
+	lock      sync.Mutex
+	endpoints *providerEndpoints
+	fetched   time.Time
+}
+
+// discoveryFromEnv configures discovery from OIDC_DISCOVERY (true/false) or an
+// explicit OIDC_DISCOVERY_URL. It returns nil when discovery is disabled.
+func discoveryFromEnv(settings *Settings, domain string, issuer string, client *http.Client) (*providerDiscovery, error) {
+	discoveryURL := settings.Get("OIDC_DISCOVERY_URL")
+	if len(discoveryURL) == 0 {
+		enabled, err := settings.Bool("OIDC_DISCOVERY", false)
+		if err != nil || !enabled {
+			return nil, err
+		}
+		discoveryURL = strings.TrimSuffix(domain, "/") + wellKnownPath
+	}
+
+	pd := &providerDiscovery{
+		URL:     discoveryURL,
+		Issuer:  issuer,
+		Refresh: defaultDiscoveryRefresh,
+		client:  client,
+	}
+	var err error
+	if pd.Refresh, err = positiveDuration(settings, "OIDC_DISCOVERY_REFRESH", defaultDiscoveryRefresh); err != nil {
+		return nil, err
+	}
+	if _, err = pd.expectedIssuer(); err != nil {
+		return nil, err
+	}
+	return pd, nil
+}
+
+// get returns the cached endpoints, reloading the document when stale.
+func (pd *providerDiscovery) get() (*providerEndpoints, error) {
+	pd.lock.Lock()
+	defer pd.lock.Unlock()
+
+	if pd.endpoints != nil && time.Since(pd.fetched) < pd.Refresh {
+		return pd.endpoints, nil
+	}
+	endpoints, err := pd.fetch()
+	if err != nil {
+		if pd.endpoints != nil {
+			fmt.Printf("Error refreshing provider metadata, keeping cached copy: %s\n", err)
+			pd.fetched = time.Now()
+			return pd.endpoints, nil
+		}
+		return nil, err
+	}
+	pd.endpoints = endpoints
+	pd.fetched = time.Now()
+	return endpoints, nil
+}
+
+func (pd *providerDiscovery) fetch() (*providerEndpoints, error) {
+	resp, err := pd.client.Get(pd.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("provider metadata request returned %s", resp.Status)
+	}
+
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := &providerEndpoints{}
+	if err := json.Unmarshal(payload, endpoints); err != nil {
+		return nil, err
+	}
+
+	if len(endpoints.Issuer) == 0 || len(endpoints.Authorization) == 0 || len(endpoints.Token) == 0 {
+		return nil, errors.New("provider metadata is missing issuer, authorization_endpoint or token_endpoint")
+	}
+	issuer, err := pd.expectedIssuer()
+	if err != nil {
+		return nil, err
+	}
+	if endpoints.Issuer != issuer {
+		return nil, fmt.Errorf("provider metadata issuer %q does not match the expected issuer %q; set OIDC_ISSUER if the provider uses another issuer, as UAA does", endpoints.Issuer, issuer)
+	}
+	return endpoints, nil
+}
+
+// expectedIssuer is the configured issuer or, as OpenID Connect Discovery
+// requires, the discovery url without the well-known suffix.
+func (pd *providerDiscovery) expectedIssuer() (string, error) {
+	if len(pd.Issuer) > 0 {
+		return pd.Issuer, nil
+	}
+	if !strings.HasSuffix(pd.URL, wellKnownPath) {
+		return "", fmt.Errorf("cannot derive the issuer from discovery url %s; set OIDC_ISSUER", pd.URL)
+	}
+	return strings.TrimSuffix(pd.URL, wellKnownPath), nil
+}
+
+// endpoints returns the discovered endpoints, or the UAA defaults when
+// discovery is disabled or has never succeeded.
+func (ac *authConfig) endpoints() *providerEndpoints {
+	if ac.discovery == nil {
+		return ac.staticEndpoints
+	}
+	endpoints, err := ac.discovery.get()
+	if err != nil {
+		fmt.Printf("Error loading provider metadata: %s\n", err)
+		return ac.staticEndpoints
+	}
+	return endpoints
+}
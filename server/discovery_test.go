@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newMetadataServer serves a provider metadata document naming issuer; an
+// empty issuer means the server's own url.
+func newMetadataServer(issuer string) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iss := issuer
+		if len(iss) == 0 {
+			iss = ts.URL
+		}
+		fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%s/authorize","token_endpoint":"%s/token"}`, iss, ts.URL, ts.URL)
+	}))
+	return ts
+}
+
+func TestDiscoveryIssuer(t *testing.T) {
+	tests := []struct {
+		name       string
+		docIssuer  string
+		configured string
+		path       string
+		err        string
+	}{
+		{name: "issuer is the discovery url", path: wellKnownPath},
+		{name: "issuer differs from the discovery url", docIssuer: "https://evil.example.com", path: wellKnownPath, err: "does not match"},
+		{name: "configured issuer", docIssuer: "https://login.example.com/oauth/token", configured: "https://login.example.com/oauth/token", path: wellKnownPath},
+		{name: "configured issuer differs", configured: "https://login.example.com/oauth/token", path: wellKnownPath, err: "does not match"},
+		{name: "custom discovery path without an issuer", path: "/metadata", err: "set OIDC_ISSUER"},
+	}
+	for _, tt := range tests {
+		ts := newMetadataServer(tt.docIssuer)
+		pd := &providerDiscovery{URL: ts.URL + tt.path, Issuer: tt.configured, Refresh: defaultDiscoveryRefresh, client: http.DefaultClient}
+		endpoints, err := pd.get()
+		ts.Close()
+		if len(tt.err) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			} else if len(endpoints.Token) == 0 {
+				t.Errorf("%s: no token endpoint", tt.name)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestUAAEndpointsIncludeRevocation(t *testing.T) {
+	endpoints := uaaEndpoints("https://login.example.com", testIssuer)
+	if endpoints.Revocation != "https://login.example.com/oauth/token/revoke" {
+		t.Fatalf("revocation endpoint = %q", endpoints.Revocation)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/astaxie/beego/session"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const (
+	tokenExchangeGrant  = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType     = "urn:ietf:params:oauth:token-type:access_token"
+	defaultExchangeAud  = "oauth-backing-service"
+	maxExchangedEntries = 1000
+)
+
+// tokenExchange trades the user's access token for a down-scoped token
+// restricted to one audience (RFC 8693) before calling a downstream service.
+// Exchanged tokens are cached per user and audience until they near expiry.
+type tokenExchange struct {
+	Enabled bool
+	// Audience is the downstream service the exchanged token is issued for
+	Audience string
+	// Scopes, when set, narrows the exchanged token to these scopes
+	Scopes []string
+	// Fallback forwards the user's own token when the exchange fails
+	Fallback bool
+	// keys serializes exchanges per cache key; lock only guards the cache
+	keys  keyedLocks
+	lock  sync.Mutex
+	cache map[string]*oauth2.Token
+}
+
+// tokenExchangeFromEnv reads TOKEN_EXCHANGE, TOKEN_EXCHANGE_AUDIENCE,
+// TOKEN_EXCHANGE_SCOPES and TOKEN_EXCHANGE_FALLBACK.
+func tokenExchangeFromEnv(settings *Settings) (*tokenExchange, error) {
+	te := &tokenExchange{
+		Audience: settings.Get("TOKEN_EXCHANGE_AUDIENCE"),
+		Scopes:   splitList(settings.Get("TOKEN_EXCHANGE_SCOPES")),
+		cache:    make(map[string]*oauth2.Token),
+	}
+	if len(te.Audience) == 0 {
+		te.Audience = defaultExchangeAud
+	}
+	var err error
+	if te.Enabled, err = settings.Bool("TOKEN_EXCHANGE", false); err != nil {
+		return nil, err
+	}
+	if te.Fallback, err = settings.Bool("TOKEN_EXCHANGE_FALLBACK", false); err != nil {
+		return nil, err
+	}
+	return te, nil
+}
+
+// downstreamToken returns the access token to send to audience on behalf of
+// the user holding token. With the exchange disabled, or when it fails and
+// fallback is allowed, that is the user's own token.
+func (ac *authConfig) downstreamToken(token *oauth2.Token, audience string, scopes []string) (string, error) {
+	if !ac.Exchange.Enabled {
+		return token.AccessToken, nil
+	}
+	return ac.exchangedToken(token, audience, scopes)
+}
+
+// exchangedToken returns a cached or newly exchanged token for audience,
+// regardless of whether the exchange is enabled for the backing page.
+func (ac *authConfig) exchangedToken(token *oauth2.Token, audience string, scopes []string) (string, error) {
+	te := ac.Exchange
+	if len(audience) == 0 {
+		audience = te.Audience
+	}
+	if len(scopes) == 0 {
+		scopes = te.Scopes
+	}
+
+	user := tokenSubject(token.AccessToken, ac)
+	key := user + " " + audience + " " + strings.Join(scopes, " ")
+
+	// Concurrent requests for the same key wait for one exchange and then
+	// find its result in the cache; other keys are not held up
+	defer te.keys.lock(key)()
+	te.lock.Lock()
+	cached, ok := te.cache[key]
+	te.lock.Unlock()
+	if ok && !needsRefresh(cached, ac.RefreshMargin) {
+		return cached.AccessToken, nil
+	}
+
+	exchanged, err := exchangeToken(ac.context(), ac, token.AccessToken, audience, scopes)
+	if err != nil {
+		if te.Fallback {
+			fmt.Printf("Token exchange for %s failed, forwarding the user's token: %s\n", audience, err)
+			return token.AccessToken, nil
+		}
+		return "", err
+	}
+	if exchanged.Expiry.IsZero() {
+		// Without an expiry the token cannot be safely reused
+		return exchanged.AccessToken, nil
+	}
+	te.lock.Lock()
+	te.prune(ac)
+	te.cache[key] = exchanged
+	te.lock.Unlock()
+	return exchanged.AccessToken, nil
+}
+
+// prune drops expired entries and, if the cache is still full, empties it.
+// It must be called with the lock held.
+func (te *tokenExchange) prune(config *authConfig) {
+	for key, t := range te.cache {
+		if needsRefresh(t, config.RefreshMargin) {
+			delete(te.cache, key)
+		}
+	}
+	if len(te.cache) >= maxExchangedEntries {
+		te.cache = make(map[string]*oauth2.Token)
+	}
+}
+
+// forget drops every cached token exchanged for user.
+func (te *tokenExchange) forget(user string) {
+	if len(user) == 0 {
+		return
+	}
+	te.lock.Lock()
+	defer te.lock.Unlock()
+	for key := range te.cache {
+		if strings.HasPrefix(key, user+" ") {
+			delete(te.cache, key)
+		}
+	}
+}
+
+// forgetSessionUser drops the exchanged tokens of the user signed in to sess.
+func (te *tokenExchange) forgetSessionUser(sess session.Store) {
+	if profile, ok := sess.Get("profile").(map[string]interface{}); ok {
+		sub, _ := profile["sub"].(string)
+		te.forget(sub)
+	}
+}
+
+// tokenSubject identifies the user an access token was issued to. Tokens
+// that cannot be parsed are keyed by their hash so they never share a cache
+// entry with another user.
+func tokenSubject(accessToken string, config *authConfig) string {
+	if t, err := parseToken(accessToken, config); err == nil {
+		if sub, ok := t.Claims["sub"].(string); ok && len(sub) > 0 {
+			return sub
+		}
+	}
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// exchangeToken redeems subjectToken for a token limited to audience and scopes.
+func exchangeToken(ctx context.Context, config *authConfig, subjectToken string, audience string, scopes []string) (*oauth2.Token, error) {
+	if len(subjectToken) == 0 {
+		return nil, errors.New("no subject token to exchange")
+	}
+	v := url.Values{
+		"grant_type":           {tokenExchangeGrant},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {accessTokenType},
+		"requested_token_type": {accessTokenType},
+		"audience":             {audience},
+	}
+	if len(scopes) > 0 {
+		v.Set("scope", strings.Join(scopes, " "))
+	}
+	return retrieveToken(ctx, config, v)
+}
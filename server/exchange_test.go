@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestExchangedTokenDoesNotBlockOtherUsers(t *testing.T) {
+	config := newTestConfig()
+	config.Exchange = &tokenExchange{Enabled: true, Audience: "backend", cache: make(map[string]*oauth2.Token)}
+	release := make(chan struct{})
+	var lock sync.Mutex
+	calls := map[string]int{}
+	ts := newTokenServer(config, func(w http.ResponseWriter, r *http.Request) {
+		subject := tokenSubject(r.PostFormValue("subject_token"), config)
+		lock.Lock()
+		calls[subject]++
+		lock.Unlock()
+		if subject == "slow-user" {
+			<-release
+		}
+		writeTokenResponse(w, "exchanged-"+subject, "")
+	})
+	defer ts.Close()
+
+	userToken := func(sub string) *oauth2.Token {
+		claims := accessTokenClaims("test.access")
+		claims["sub"] = sub
+		return &oauth2.Token{AccessToken: signTestToken(t, claims, nil, nil)}
+	}
+	slow := userToken("slow-user")
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := config.exchangedToken(slow, "", nil); err != nil || got != "access-exchanged-slow-user" {
+				t.Errorf("slow user got %q, %v", got, err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if got, err := config.exchangedToken(userToken("other-user"), "", nil); err != nil || got != "access-exchanged-other-user" {
+			t.Errorf("other user got %q, %v", got, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow exchange for one user blocked another user")
+	}
+
+	close(release)
+	wg.Wait()
+	if calls["slow-user"] != 1 {
+		t.Errorf("exchanged the slow user's token %d times, want once", calls["slow-user"])
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/astaxie/beego/session"
+)
+
+// forwardAuthConfig configures /auth/verify and /auth/start for proxies such
+// as nginx auth_request or Traefik ForwardAuth that ask this app whether a
+// request may pass.
+type forwardAuthConfig struct {
+	// Policy holds the scope rules applied to the original request's URI
+	Policy *accessPolicy
+	// PassAccessToken adds the user's access token to the response headers
+	PassAccessToken bool
+}
+
+// forwardAuthFromEnv reads FORWARD_AUTH_POLICY_FILE and
+// FORWARD_AUTH_PASS_ACCESS_TOKEN. Without a policy file any signed-in user
+// is admitted. The hosts /auth/start may return to are listed in
+// FORWARD_AUTH_DOMAINS, see redirectPolicyFromEnv.
+func forwardAuthFromEnv(settings *Settings) (*forwardAuthConfig, error) {
+	fa := &forwardAuthConfig{Policy: gatewayPolicy}
+	var err error
+	if file := settings.Get("FORWARD_AUTH_POLICY_FILE"); len(file) > 0 {
+		if fa.Policy, err = policyFromFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if fa.PassAccessToken, err = settings.Bool("FORWARD_AUTH_PASS_ACCESS_TOKEN", false); err != nil {
+		return nil, err
+	}
+	return fa, nil
+}
+
+// originalRequest returns the method and URI of the request the proxy is
+// asking about, from nginx's X-Original-* or Traefik's X-Forwarded-* headers.
+func originalRequest(r *http.Request) (method string, uri string) {
+	method = r.Header.Get("X-Original-Method")
+	if len(method) == 0 {
+		method = r.Header.Get("X-Forwarded-Method")
+	}
+	if len(method) == 0 {
+		method = "GET"
+	}
+	uri = r.Header.Get("X-Original-URI")
+	if len(uri) == 0 {
+		uri = r.Header.Get("X-Forwarded-Uri")
+	}
+	return strings.ToUpper(method), uri
+}
+
+// canonicalPath reports whether the unescaped path p is absolute and free of
+// empty, ".", ".." segments and backslashes. The upstream may resolve such segments to
+// another path than the one the policy would match, so they are refused.
+func canonicalPath(p string) bool {
+	if !strings.HasPrefix(p, "/") || strings.Contains(p, "\\") {
+		return false
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean == p
+}
+
+// verifyHandler answers 200 with identity headers when the session may access
+// the original URI, 401 when there is no valid session and 403 when the access
+// policy denies the request.
+func verifyHandler(sessionManager *session.Manager, config *authConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		method, uri := originalRequest(r)
+		u, err := url.ParseRequestURI(uri)
+		if err != nil {
+			http.Error(w, "Missing or invalid X-Original-URI", http.StatusBadRequest)
+			return
+		}
+		if !canonicalPath(u.Path) {
+			fmt.Printf("Forward auth refused non-canonical path %q\n", uri)
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		session, err := startSession(sessionManager, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		profile, _ := session.Get("profile").(map[string]interface{})
+		provider := config.forSession(session)
+		token, err := sessionToken(sessionManager, session, provider)
+		if rerr := releaseSession(w, session); rerr != nil {
+			fmt.Printf("Forward auth could not save session: %s\n", rerr)
+			http.Error(w, rerr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err != nil && !refreshRejected(err) {
+			fmt.Printf("Forward auth could not refresh token: %s\n", err)
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		accessToken, err := parseToken(token.AccessToken, provider)
+		if err != nil {
+			fmt.Printf("Forward auth rejected token: %s\n", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		policy := config.ForwardAuth.Policy
+		rule := policy.rule(method, u.Path)
+		allowed := policy.Default == "allow"
+		if rule != nil {
+			allowed = rule.allows(accessToken)
+		}
+		if !allowed {
+			fmt.Printf("Forward auth denied %s %s\n", method, u.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		profile = config.upstreamProfile(provider, profile)
+		user := profileUser(profile)
+		email, _ := profile["email"].(string)
+		w.Header().Set("X-Auth-Request-User", user)
+		w.Header().Set("X-Forwarded-User", user)
+		w.Header().Set("X-Auth-Request-Provider", provider.Name)
+		w.Header().Set("X-Forwarded-Provider", provider.Name)
+		if len(email) > 0 {
+			w.Header().Set("X-Auth-Request-Email", email)
+			w.Header().Set("X-Forwarded-Email", email)
+		}
+		if config.ForwardAuth.PassAccessToken {
+			w.Header().Set("X-Auth-Request-Access-Token", token.AccessToken)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// authStartHandler starts a login that returns to the rd parameter. Like
+// /login it offers the provider chooser unless the provider parameter names one.
+func authStartHandler(sessionManager *session.Manager, config *authConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rd := r.URL.Query().Get("rd")
+		if _, ok := config.safeReturnTo(rd); len(rd) > 0 && !ok {
+			fmt.Printf("Refused login return url %q\n", rd)
+			errorPage(w, http.StatusBadRequest, "Login Failed", "The return address is not allowed.")
+			return
+		}
+		chooseProvider(sessionManager, config, w, r, rd)
+	}
+}
+
+// profileUser returns the user name shown to upstream apps.
+func profileUser(profile map[string]interface{}) string {
+	user, _ := profile["user_name"].(string)
+	if len(user) == 0 {
+		user, _ = profile["sub"].(string)
+	}
+	return user
+}
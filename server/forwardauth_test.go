@@ -0,0 +1,74 @@
+package server
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestVerifyHandlerPaths(t *testing.T) {
+	config := newTestConfig()
+	config.Providers = &providerRegistry{list: []*authConfig{config}, byName: map[string]*authConfig{config.Name: config}}
+	config.ForwardAuth = &forwardAuthConfig{Policy: &accessPolicy{Default: "deny", Rules: []policyRule{
+		{Path: "/public/**"},
+		{Path: "/admin/**", Scopes: []string{"test.admin"}},
+	}}}
+	if err := config.ForwardAuth.Policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	sm := newTestSessionManager(t)
+	token := &oauth2.Token{AccessToken: signTestToken(t, accessTokenClaims("test.access"), nil, nil)}
+
+	tests := []struct {
+		uri    string
+		status int
+	}{
+		{"/public/page", http.StatusOK},
+		{"/public/dir/", http.StatusOK},
+		{"/public/page?next=/admin", http.StatusOK},
+		{"/admin/users", http.StatusForbidden},
+		{"/public/../admin/users", http.StatusBadRequest},
+		{"/public/%2e%2e/admin/users", http.StatusBadRequest},
+		{"/public%2F..%2Fadmin/users", http.StatusBadRequest},
+		{"//admin/users", http.StatusBadRequest},
+		{"/public//admin", http.StatusBadRequest},
+		{"/public/./page", http.StatusBadRequest},
+		{"/public/..\\admin", http.StatusBadRequest},
+		{"public/page", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := loggedInRequest(t, sm, "GET", "/auth/verify", token)
+		r.Header.Set("X-Original-URI", tt.uri)
+		w := httptest.NewRecorder()
+		verifyHandler(sm, config)(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.uri, w.Code, tt.status)
+		}
+	}
+}
+
+func TestAuthStartOffersProviders(t *testing.T) {
+	config, _ := newTestProviders(t)
+	config.Redirects = &redirectPolicy{Hosts: []string{".apps.example.com"}}
+	config.Logout = &logoutConfig{LandingURL: "/"}
+	sm := newTestSessionManager(t)
+	rd := "https://reports.apps.example.com/q1"
+
+	w := httptest.NewRecorder()
+	authStartHandler(sm, config)(w, httptest.NewRequest("GET", "/auth/start?rd="+url.QueryEscape(rd), nil))
+	want := html.EscapeString("/login?" + url.Values{"provider": {"partner"}, "rd": {rd}}.Encode())
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("status %d, no link to %s in %s", w.Code, want, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	authStartHandler(sm, config)(w, httptest.NewRequest("GET", "/auth/start?provider=partner&rd="+url.QueryEscape(rd), nil))
+	if location := w.Header().Get("Location"); w.Code != http.StatusFound || !strings.HasPrefix(location, "https://partner.example.org/") {
+		t.Fatalf("status %d, redirected to %s", w.Code, location)
+	}
+}
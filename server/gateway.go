@@ -0,0 +1,227 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/session"
+	"github.com/codegangsta/negroni"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultGatewayJWTHeader = "X-Forwarded-Jwt"
+	defaultGatewayJWTTTL    = 5 * time.Minute
+	gatewayIssuer           = "oauth-authcode"
+)
+
+// Identity headers set by the gateway. Copies sent by the client are removed.
+var gatewayHeaders = []string{"X-Forwarded-User", "X-Forwarded-Email", "X-Forwarded-Provider", "X-Forwarded-Access-Token"}
+
+// gatewayPolicy admits any signed-in user when no policy file is given.
+var gatewayPolicy = &accessPolicy{Default: "allow"}
+
+// gatewayConfig runs the app as an authenticating reverse proxy: every path
+// that is not one of the app's own routes is forwarded to Upstream for
+// signed-in users, with their identity in request headers.
+type gatewayConfig struct {
+	Upstream *url.URL
+	// Headers sets X-Forwarded-User and X-Forwarded-Email
+	Headers bool
+	// PassAccessToken sets X-Forwarded-Access-Token to the user's access token
+	PassAccessToken bool
+	// JWTHeader, when set, names the header carrying a signed identity JWT
+	JWTHeader string
+	// JWTSecret is the HS256 key the upstream uses to verify that JWT
+	JWTSecret []byte
+	JWTTTL    time.Duration
+	// Policy holds the per-path scope rules for proxied requests
+	Policy *accessPolicy
+	// Transport reaches the upstream. It trusts the same CAs as the provider
+	// client but presents no client certificate.
+	Transport http.RoundTripper
+}
+
+// gatewayFromEnv enables the gateway when PROXY_UPSTREAM is set. The identity
+// is passed as headers, a JWT or both according to PROXY_IDENTITY; the JWT is
+// signed with PROXY_JWT_SECRET and sent in PROXY_JWT_HEADER for PROXY_JWT_TTL.
+// PROXY_PASS_ACCESS_TOKEN forwards the access token and PROXY_POLICY_FILE
+// holds the scope rules.
+func gatewayFromEnv(settings *Settings) (*gatewayConfig, error) {
+	upstream := settings.Get("PROXY_UPSTREAM")
+	if len(upstream) == 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, invalidSetting(settings, "PROXY_UPSTREAM", upstream, "an absolute http(s) url")
+	}
+	ot, err := outboundTLSFromEnv(settings)
+	if err != nil {
+		return nil, err
+	}
+	// The client certificate identifies the app to the provider, not to the upstream
+	ot.CertFile, ot.KeyFile = "", ""
+	tc, err := ot.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	gc := &gatewayConfig{
+		Upstream:  u,
+		JWTTTL:    defaultGatewayJWTTTL,
+		Policy:    gatewayPolicy,
+		Transport: newTransport(tc, ot.Timeout),
+	}
+
+	switch identity := settings.Get("PROXY_IDENTITY"); strings.ToLower(identity) {
+	case "", "headers":
+		gc.Headers = true
+	case "jwt":
+		gc.JWTHeader = defaultGatewayJWTHeader
+	case "both":
+		gc.Headers = true
+		gc.JWTHeader = defaultGatewayJWTHeader
+	default:
+		return nil, invalidSetting(settings, "PROXY_IDENTITY", identity, "headers, jwt or both")
+	}
+	if len(gc.JWTHeader) > 0 {
+		if header := settings.Get("PROXY_JWT_HEADER"); len(header) > 0 {
+			gc.JWTHeader = header
+		}
+		gc.JWTSecret = []byte(settings.Get("PROXY_JWT_SECRET"))
+		if len(gc.JWTSecret) < 32 {
+			return nil, errors.New("The gateway identity JWT requires a PROXY_JWT_SECRET of at least 32 bytes.")
+		}
+		if gc.JWTTTL, err = positiveDuration(settings, "PROXY_JWT_TTL", defaultGatewayJWTTTL); err != nil {
+			return nil, err
+		}
+	}
+	if gc.PassAccessToken, err = settings.Bool("PROXY_PASS_ACCESS_TOKEN", false); err != nil {
+		return nil, err
+	}
+	if file := settings.Get("PROXY_POLICY_FILE"); len(file) > 0 {
+		if gc.Policy, err = policyFromFile(file); err != nil {
+			return nil, err
+		}
+	}
+	return gc, nil
+}
+
+// gatewayHandler authenticates and authorizes the request, then forwards it
+// to the upstream.
+func gatewayHandler(sessionManager *session.Manager, config *authConfig) http.Handler {
+	return negroni.New(
+		negroni.HandlerFunc(isAuthenticated(sessionManager, config)),
+		negroni.HandlerFunc(refreshSessionToken(sessionManager, config)),
+		negroni.HandlerFunc(authorizePolicy(sessionManager, config, config.Gateway.Policy)),
+		negroni.Wrap(gatewayProxy(sessionManager, config)),
+	)
+}
+
+func gatewayProxy(sessionManager *session.Manager, config *authConfig) http.Handler {
+	gc := config.Gateway
+	proxy := httputil.NewSingleHostReverseProxy(gc.Upstream)
+	proxy.Transport = gc.Transport
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := startSession(sessionManager, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		profile, _ := session.Get("profile").(map[string]interface{})
+		releaseSession(w, session)
+		token, provider, err := tokenFromSession(sessionManager, w, r, config)
+		if err != nil {
+			config.redirect(w, r, "/login")
+			return
+		}
+
+		out := new(http.Request)
+		*out = *r
+		out.Header = make(http.Header)
+		for key, values := range r.Header {
+			out.Header[key] = values
+		}
+		stripIdentity(out.Header, gc.JWTHeader)
+
+		profile = config.upstreamProfile(provider, profile)
+		if gc.Headers {
+			out.Header.Set("X-Forwarded-User", profileUser(profile))
+			if email, ok := profile["email"].(string); ok {
+				out.Header.Set("X-Forwarded-Email", email)
+			}
+			out.Header.Set("X-Forwarded-Provider", provider.Name)
+		}
+		if gc.PassAccessToken {
+			out.Header.Set("X-Forwarded-Access-Token", token.AccessToken)
+		}
+		if len(gc.JWTHeader) > 0 {
+			signed, err := gc.identityJWT(profile, token, provider)
+			if err != nil {
+				fmt.Printf("Error signing gateway identity token: %s\n", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			out.Header.Set(gc.JWTHeader, signed)
+		}
+		proxy.ServeHTTP(w, out)
+	})
+}
+
+// stripIdentity removes identity headers supplied by the client, and the
+// app's own session cookie, so the upstream only sees what the gateway set.
+func stripIdentity(h http.Header, jwtHeader string) {
+	for _, header := range gatewayHeaders {
+		h.Del(header)
+	}
+	if len(jwtHeader) > 0 {
+		h.Del(jwtHeader)
+	}
+	h.Del("Authorization")
+
+	var cookies []string
+	for _, line := range h["Cookie"] {
+		for _, cookie := range strings.Split(line, ";") {
+			cookie = strings.TrimSpace(cookie)
+			if len(cookie) > 0 && !strings.HasPrefix(cookie, sessionCookieName+"=") {
+				cookies = append(cookies, cookie)
+			}
+		}
+	}
+	h.Del("Cookie")
+	if len(cookies) > 0 {
+		h.Set("Cookie", strings.Join(cookies, "; "))
+	}
+}
+
+// identityJWT signs the user's identity for the upstream, which verifies it
+// with the shared PROXY_JWT_SECRET. idp names the provider the user logged in
+// with and idp_iss its issuer.
+func (gc *gatewayConfig) identityJWT(profile map[string]interface{}, token *oauth2.Token, config *authConfig) (string, error) {
+	t := jwt.New(jwt.SigningMethodHS256)
+	for _, claim := range []string{"sub", "user_name", "email", "name"} {
+		if v, ok := profile[claim]; ok {
+			t.Claims[claim] = v
+		}
+	}
+	if accessToken, err := parseToken(token.AccessToken, config); err == nil {
+		t.Claims["scope"] = claimStrings(accessToken.Claims["scope"])
+	}
+	t.Claims["idp"] = config.Name
+	if endpoints := config.endpoints(); endpoints != nil && len(endpoints.Issuer) > 0 {
+		t.Claims["idp_iss"] = endpoints.Issuer
+	}
+	now := time.Now()
+	t.Claims["iss"] = gatewayIssuer
+	t.Claims["aud"] = gc.Upstream.String()
+	t.Claims["iat"] = now.Unix()
+	t.Claims["exp"] = now.Add(gc.JWTTTL).Unix()
+	return t.SignedString(gc.JWTSecret)
+}
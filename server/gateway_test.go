@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGatewayTransport(t *testing.T) {
+	caFile, _ := writeTestKeyPair(t, "platform-ca")
+	certFile, keyFile := writeTestKeyPair(t, "client")
+	gc, err := gatewayFromEnv(newTestSettings(map[string]string{
+		"PROXY_UPSTREAM":       "https://upstream.example.com",
+		"SKIP_SSL_VALIDATION":  "true",
+		"TLS_CA_FILES":         caFile,
+		"TLS_CLIENT_CERT_FILE": certFile,
+		"TLS_CLIENT_KEY_FILE":  keyFile,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, ok := gc.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("transport is %T", gc.Transport)
+	}
+	if hasClientCertificate(&http.Client{Transport: tr}) || len(tr.TLSClientConfig.Certificates) > 0 {
+		t.Error("the upstream transport presents a client certificate")
+	}
+	if !tr.TLSClientConfig.InsecureSkipVerify {
+		t.Error("the upstream transport ignores SKIP_SSL_VALIDATION")
+	}
+	if !trustsCertificate(t, tr.TLSClientConfig.RootCAs, caFile) {
+		t.Error("the upstream transport does not trust TLS_CA_FILES")
+	}
+}
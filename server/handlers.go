@@ -4,8 +4,8 @@ package server
 
 import (
 	"bytes"
-	"crypto/tls"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"net/http"
 	"text/template"
@@ -20,18 +20,121 @@ var homeTemplate = `
   </head>
   <body>
     <h2>Welcome to the OAuth Authcode Home Page</h2>
-    <p>We don't know who you are.  Please <a href="{{.Domain}}/oauth/authorize?client_id={{.ClientID}}&redirect_uri={{.CallbackURL}}&response_type=code">log in</a>.
+    <p>We don't know who you are.  Please <a href="/login">log in</a>.
   </body>
 </html>
 `
 
 func homeHandler(config *authConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if len(config.Providers.list) > 1 {
+			chooserPage(w, config, "")
+			return
+		}
 		t := template.Must(template.New("html").Parse(homeTemplate))
 		t.Execute(w, config)
 	}
 }
 
+// loginHandler starts a login attempt bound to the browser session and
+// redirects to the authorize endpoint of the provider named by the provider
+// parameter. Without one, and with several providers, it shows the chooser.
+// rd is the local page to return to after logging in.
+func loginHandler(sessionManager *session.Manager, config *authConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		returnTo := r.URL.Query().Get("rd")
+		if _, ok := config.safeReturnTo(returnTo); !ok {
+			returnTo = ""
+		}
+		chooseProvider(sessionManager, config, w, r, returnTo)
+	}
+}
+
+// chooseProvider starts a login with the provider named by the provider
+// parameter, or shows the chooser when there are several and none is named.
+func chooseProvider(sessionManager *session.Manager, config *authConfig, w http.ResponseWriter, r *http.Request, returnTo string) {
+	name := r.URL.Query().Get("provider")
+	if len(name) == 0 {
+		if len(config.Providers.list) > 1 {
+			chooserPage(w, config, returnTo)
+			return
+		}
+		name = config.Name
+	}
+	provider, ok := config.Providers.get(name)
+	if !ok {
+		errorPage(w, http.StatusNotFound, "Login Failed", "Unknown identity provider.")
+		return
+	}
+	startLogin(sessionManager, provider, w, r, returnTo)
+}
+
+// startLogin records a new login attempt and redirects to the provider. The
+// callback sends the browser to returnTo, or to the user page when empty.
+func startLogin(sessionManager *session.Manager, config *authConfig, w http.ResponseWriter, r *http.Request, returnTo string) {
+	session, err := startSession(sessionManager, w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(returnTo) > maxReturnToLength {
+		returnTo = ""
+	}
+	attempt, err := newLoginAttempt(config)
+	if err == nil {
+		attempt.ReturnTo = returnTo
+		attempt.Provider = config.Name
+		err = saveLoginAttempt(session, attempt)
+	}
+	if err == nil {
+		err = releaseSession(w, session)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	config.redirect(w, r, config.authCodeURL(attempt))
+}
+
+// errorPage renders a simple HTML error page with the given status code.
+func errorPage(w http.ResponseWriter, status int, title string, message string) {
+	buf := bytes.NewBufferString(fmt.Sprintf(`
+			<html>
+				<head>
+					<title>%[1]s</title>
+				</head>
+				<body>
+					<h2>%[1]s</h2>
+					<p>%[2]s</p>
+					<hr/>
+			    <p>Return to the <a href="/">Home Page</a> to log in again.</p>
+				</body>
+			</html>`, html.EscapeString(title), html.EscapeString(message)))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// rejectToken responds to a session token that failed validation. Expired or
+// revoked tokens send the user back to log in; anything else is unauthorized.
+func rejectToken(w http.ResponseWriter, r *http.Request, config *authConfig, err error) {
+	fmt.Printf("Error Parsing Token: %s\n", err)
+	if isTokenError(err, tokenExpired) || isTokenError(err, tokenNotYetValid) || isTokenError(err, tokenInactive) {
+		config.redirect(w, r, "/")
+		return
+	}
+	config.redirect(w, r, "/unauthorized")
+}
+
+// crossOrigin reports whether a browser sent r from a page on another origin.
+// State-changing handlers refuse such requests.
+func crossOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return len(origin) > 0 && origin != "http://"+r.Host && origin != "https://"+r.Host
+}
+
 func unauthorizedHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -53,24 +156,10 @@ func unauthorizedHandler() http.HandlerFunc {
 	}
 }
 
-func accessHandler(sessionManager *session.Manager, config *authConfig) http.HandlerFunc {
-
+func accessHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token, err := tokenFromSession(sessionManager, w, r)
-		if err != nil {
-			fmt.Printf("NO TOKEN IN REQUEST: %s\n", err)
-			http.Redirect(w, r, "/unauthorized", http.StatusMovedPermanently)
-			return
-		}
-
-		accessToken, err := parseToken(token.AccessToken, config)
-		if err != nil {
-			fmt.Printf("Error Parsing Token: %s\n", err)
-		}
-
-		if hasScope(accessToken, "test.access", "test.admin") {
-			w.Header().Set("Content-Type", "text/html;charset=utf-8")
-			buf := bytes.NewBufferString(`
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+		buf := bytes.NewBufferString(`
 <html>
   <head>
     <title>Access Page</title>
@@ -82,30 +171,14 @@ func accessHandler(sessionManager *session.Manager, config *authConfig) http.Han
     <p>Return to the <a href="/protected/user">User Page</a>.</p>
   </body>
 </html>`)
-			w.Write(buf.Bytes())
-		} else {
-			http.Redirect(w, r, "/unauthorized", http.StatusMovedPermanently)
-		}
+		w.Write(buf.Bytes())
 	}
 }
 
-func adminHandler(sessionManager *session.Manager, config *authConfig) http.HandlerFunc {
-
+func adminHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token, err := tokenFromSession(sessionManager, w, r)
-		if err != nil {
-			fmt.Printf("NO TOKEN IN REQUEST: %s\n", err)
-			http.Redirect(w, r, "/unauthorized", http.StatusUnauthorized)
-		}
-
-		accessToken, err := parseToken(token.AccessToken, config)
-		if err != nil {
-			fmt.Printf("Error Parsing Token: %v", err)
-		}
-
-		if hasScope(accessToken, "test.admin") {
-			w.Header().Set("Content-Type", "text/html;charset=utf-8")
-			buf := bytes.NewBufferString(`
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+		buf := bytes.NewBufferString(`
 <html>
   <head>
     <title>Admin Page</title>
@@ -113,14 +186,16 @@ func adminHandler(sessionManager *session.Manager, config *authConfig) http.Hand
   <body>
     <h2>You have successfully reached the Admin Page</h2>
     <p>This page requires the <code>test.admin</code> scope.</p>
+    <h3>Revoke Sessions</h3>
+    <form method="POST" action="/protected/admin/revoke">
+      <p>End every session and revoke the tokens of user (sub, user name or email):
+      <input type="text" name="user"/> <input type="submit" value="Revoke"/></p>
+    </form>
     <hr/>
     <p>Return to the <a href="/protected/user">User Page</a>.</p>
   </body>
 </html>`)
-			w.Write(buf.Bytes())
-		} else {
-			http.Redirect(w, r, "/unauthorized", http.StatusMovedPermanently)
-		}
+		w.Write(buf.Bytes())
 	}
 }
 
@@ -145,6 +220,7 @@ func userHandler(sessionManager *session.Manager, config *authConfig) http.Handl
     <p>Visit the <a href="/protected/access">Access Page</a>.</p>
     <p>Visit the <a href="/protected/admin">Admin Page</a>.</p>
 		<p>Invoke a secured <a href="/protected/backing">Backing Service</a>.</p>
+		<p><a href="/logout">Log out</a>.</p>
 		</body>
 		</html>
 		`
@@ -156,29 +232,29 @@ func userHandler(sessionManager *session.Manager, config *authConfig) http.Handl
 		ud := &userData{}
 
 		// Scopes
-		token, err := tokenFromSession(sessionManager, w, r)
+		token, provider, err := tokenFromSession(sessionManager, w, r, config)
 		if err != nil {
 			fmt.Printf("NO TOKEN IN REQUEST: %s\n", err)
-			http.Redirect(w, r, "/unauthorized", http.StatusUnauthorized)
+			config.redirect(w, r, "/unauthorized")
+			return
 		}
-		accessToken, err := parseToken(token.AccessToken, config)
+		accessToken, err := parseToken(token.AccessToken, provider)
 		if err != nil {
-			fmt.Printf("Error Parsing Token: %v", err)
+			rejectToken(w, r, config, err)
+			return
 		}
 
-		scopes := accessToken.Claims["scope"]
-		a := scopes.([]interface{})
-		for _, scope := range a {
+		for _, scope := range claimStrings(accessToken.Claims["scope"]) {
 			ud.Scopes += fmt.Sprintf("<li>%s</li>", scope)
 		}
 
 		// Profile Data
-		session, _ := sessionManager.SessionStart(w, r)
-		defer session.SessionRelease(w)
+		session, _ := startSession(sessionManager, w, r)
+		defer releaseSession(w, session)
 		profile := session.Get("profile").(map[string]interface{})
 
 		for k, v := range profile {
-			ud.ProfileData += fmt.Sprintf("<tr><td>%s</td><td>%s</td></tr>", k, v.(string))
+			ud.ProfileData += fmt.Sprintf("<tr><td>%s</td><td>%v</td></tr>", k, v)
 		}
 
 		t := template.Must(template.New("user").Parse(userTemplate))
@@ -204,12 +280,20 @@ func backingServiceHandler(sessionManager *session.Manager, config *authConfig)
 		</body>
 		</html>
 		`
-		token, err := tokenFromSession(sessionManager, w, r)
+		token, provider, err := tokenFromSession(sessionManager, w, r, config)
 		if err != nil {
 			fmt.Printf("NO TOKEN IN REQUEST: %s\n", err)
-			http.Redirect(w, r, "/unauthorized", http.StatusUnauthorized)
+			config.redirect(w, r, "/unauthorized")
+			return
+		}
+		svc, ok := config.Services[defaultBackingService]
+		if !ok {
+			errorPage(w, http.StatusNotFound, "Unknown Service", "No backing service is configured.")
+			return
+		}
+		if !svc.authorize(w, r, config, provider, token) {
+			return
 		}
-		tokenHeader := fmt.Sprintf("BEARER %s", token.AccessToken)
 
 		type serviceData struct {
 			Payload string
@@ -218,18 +302,14 @@ func backingServiceHandler(sessionManager *session.Manager, config *authConfig)
 			Payload: "--- not replaced ---",
 		}
 
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		client := &http.Client{Transport: tr}
-
-		req, _ := http.NewRequest("GET", "https://oauth-backing-service.apps.pcf.local/api/hello", nil)
-		req.Header.Set("Authorization", tokenHeader)
-		resp, err := client.Do(req)
-		defer resp.Body.Close()
+		req, _ := http.NewRequest("GET", "/api/hello", nil)
+		resp, err := svc.do(provider, token, req)
 		if err != nil {
-			http.Error(w, "COULD NOT ACCESS BACKING SERVICE", http.StatusInternalServerError)
+			fmt.Printf("Error calling backing service: %s\n", err)
+			errorPage(w, http.StatusBadGateway, "Backing Service Unavailable", "COULD NOT ACCESS BACKING SERVICE")
+			return
 		}
+		defer resp.Body.Close()
 
 		payload, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
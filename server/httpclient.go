@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultHTTPTimeout = 30 * time.Second
+	dialTimeout        = 10 * time.Second
+	tlsHandshakeTimout = 10 * time.Second
+)
+
+// outboundTLS is the trust and identity used for every call the app makes to
+// the provider and to backing services.
+type outboundTLS struct {
+	// SkipVerify disables certificate validation; for lab installs only
+	SkipVerify bool
+	// CAFiles are PEM bundles trusted in addition to the system roots
+	CAFiles []string
+	// CertFile and KeyFile hold the client certificate for mutual TLS
+	CertFile string
+	KeyFile  string
+	Timeout  time.Duration
+}
+
+// outboundTLSFromEnv reads SKIP_SSL_VALIDATION, TLS_CA_FILES (comma separated
+// paths), TLS_CLIENT_CERT_FILE, TLS_CLIENT_KEY_FILE and HTTP_TIMEOUT. On Cloud
+// Foundry the certificates in CF_SYSTEM_CERT_PATH are trusted as well, and
+// TLS_USE_INSTANCE_IDENTITY presents the container's CF_INSTANCE_CERT.
+func outboundTLSFromEnv(settings *Settings) (*outboundTLS, error) {
+	ot := &outboundTLS{
+		CAFiles:  splitList(settings.Get("TLS_CA_FILES")),
+		CertFile: settings.Get("TLS_CLIENT_CERT_FILE"),
+		KeyFile:  settings.Get("TLS_CLIENT_KEY_FILE"),
+		Timeout:  defaultHTTPTimeout,
+	}
+	var err error
+	if ot.SkipVerify, err = settings.Bool("SKIP_SSL_VALIDATION", false); err != nil {
+		return nil, err
+	}
+	if dir := settings.Get("CF_SYSTEM_CERT_PATH"); len(dir) > 0 {
+		for _, pattern := range []string{"*.crt", "*.pem"} {
+			files, _ := filepath.Glob(filepath.Join(dir, pattern))
+			ot.CAFiles = append(ot.CAFiles, files...)
+		}
+	}
+	useInstance, err := settings.Bool("TLS_USE_INSTANCE_IDENTITY", false)
+	if err != nil {
+		return nil, err
+	}
+	if useInstance {
+		ot.CertFile = settings.Get("CF_INSTANCE_CERT")
+		ot.KeyFile = settings.Get("CF_INSTANCE_KEY")
+		if len(ot.CertFile) == 0 || len(ot.KeyFile) == 0 {
+			return nil, errors.New("TLS_USE_INSTANCE_IDENTITY requires CF_INSTANCE_CERT and CF_INSTANCE_KEY.")
+		}
+	}
+	if (len(ot.CertFile) == 0) != (len(ot.KeyFile) == 0) {
+		return nil, errors.New("TLS_CLIENT_CERT_FILE and TLS_CLIENT_KEY_FILE must be set together.")
+	}
+	if ot.Timeout, err = positiveDuration(settings, "HTTP_TIMEOUT", defaultHTTPTimeout); err != nil {
+		return nil, err
+	}
+	return ot, nil
+}
+
+// tlsConfig builds the client TLS configuration.
+func (ot *outboundTLS) tlsConfig() (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ot.SkipVerify {
+		fmt.Println("WARNING: SKIP_SSL_VALIDATION is set; server certificates are not verified")
+		tc.InsecureSkipVerify = true
+	}
+
+	if len(ot.CAFiles) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		for _, file := range ot.CAFiles {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("Could not read CA bundle: %s", err)
+			}
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("CA bundle %s contains no certificates", file)
+			}
+		}
+		tc.RootCAs = roots
+	}
+
+	if len(ot.CertFile) > 0 {
+		loader := &clientCertificate{certFile: ot.CertFile, keyFile: ot.KeyFile}
+		if _, err := loader.get(); err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %s", err)
+		}
+		tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return loader.get()
+		}
+	}
+	return tc, nil
+}
+
+// clientCertificate reloads the key pair when the certificate file changes,
+// as Cloud Foundry rotates instance identity certificates in place.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func (cc *clientCertificate) get() (*tls.Certificate, error) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	info, err := os.Stat(cc.certFile)
+	if err != nil {
+		if cc.cert != nil {
+			return cc.cert, nil
+		}
+		return nil, err
+	}
+	if cc.cert != nil && !info.ModTime().After(cc.modTime) {
+		return cc.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cc.certFile, cc.keyFile)
+	if err != nil {
+		if cc.cert != nil {
+			fmt.Printf("Error reloading client certificate, keeping the previous one: %s\n", err)
+			return cc.cert, nil
+		}
+		return nil, err
+	}
+	cc.cert = &cert
+	cc.modTime = info.ModTime()
+	return cc.cert, nil
+}
+
+// newHTTPClient returns the client shared by every outbound call.
+func newHTTPClient(ot *outboundTLS) (*http.Client, error) {
+	tc, err := ot.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: newTransport(tc, ot.Timeout), Timeout: ot.Timeout}, nil
+}
+
+// newTransport returns a transport using tc with the app's dial and header
+// timeouts.
+func newTransport(tc *tls.Config, timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSClientConfig:       tc,
+		TLSHandshakeTimeout:   tlsHandshakeTimout,
+		ResponseHeaderTimeout: timeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   10,
+	}
+}
+
+// httpClientFromEnv builds the shared outbound client from the environment.
+func httpClientFromEnv(settings *Settings) (*http.Client, error) {
+	ot, err := outboundTLSFromEnv(settings)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPClient(ot)
+}
+
+// context returns a context carrying the shared client for the oauth2 package
+// and the token helpers.
+func (ac *authConfig) context() context.Context {
+	return context.WithValue(oauth2.NoContext, oauth2.HTTPClient, ac.HTTPClient)
+}
+
+// clientWithTimeout shares the outbound transport but bounds whole calls by
+// timeout instead of the default.
+func (ac *authConfig) clientWithTimeout(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: ac.HTTPClient.Transport, Timeout: timeout}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboundTLSFromEnv(t *testing.T) {
+	certDir := t.TempDir()
+	for _, name := range []string{"a.crt", "b.pem", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(certDir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ot, err := outboundTLSFromEnv(newTestSettings(map[string]string{
+		"TLS_CA_FILES":        "/etc/ca/one.pem, /etc/ca/two.pem",
+		"CF_SYSTEM_CERT_PATH": certDir,
+		"SKIP_SSL_VALIDATION": "true",
+		"HTTP_TIMEOUT":        "5s",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/etc/ca/one.pem", "/etc/ca/two.pem", filepath.Join(certDir, "a.crt"), filepath.Join(certDir, "b.pem")}
+	if !reflect.DeepEqual(ot.CAFiles, want) || !ot.SkipVerify || ot.Timeout != 5*time.Second {
+		t.Fatalf("got %+v", ot)
+	}
+
+	tests := []struct {
+		values map[string]string
+		err    string
+	}{
+		{map[string]string{"SKIP_SSL_VALIDATION": "maybe"}, "SKIP_SSL_VALIDATION"},
+		{map[string]string{"TLS_CLIENT_CERT_FILE": "client.crt"}, "must be set together"},
+		{map[string]string{"TLS_CLIENT_KEY_FILE": "client.key"}, "must be set together"},
+		{map[string]string{"TLS_USE_INSTANCE_IDENTITY": "true"}, "requires CF_INSTANCE_CERT"},
+		{map[string]string{"HTTP_TIMEOUT": "0s"}, "HTTP_TIMEOUT"},
+	}
+	for _, tt := range tests {
+		if _, err := outboundTLSFromEnv(newTestSettings(tt.values)); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: error = %v, want %q", tt.values, err, tt.err)
+		}
+	}
+}
+
+func TestOutboundTLSConfig(t *testing.T) {
+	caFile, _ := writeTestKeyPair(t, "platform-ca")
+	tc, err := (&outboundTLS{CAFiles: []string{caFile}}).tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !trustsCertificate(t, tc.RootCAs, caFile) || tc.InsecureSkipVerify || tc.GetClientCertificate != nil {
+		t.Fatal("the CA bundle is not trusted, or unexpected settings were made")
+	}
+	if tc, err = (&outboundTLS{SkipVerify: true}).tlsConfig(); err != nil || !tc.InsecureSkipVerify {
+		t.Fatalf("SKIP_SSL_VALIDATION: error %v", err)
+	}
+
+	certFile, keyFile := writeTestKeyPair(t, "client")
+	otherKey := writeTestFile(t, "other.key", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(partnerSigningKey)})))
+	tests := []struct {
+		name string
+		ot   *outboundTLS
+		err  string
+	}{
+		{"missing CA bundle", &outboundTLS{CAFiles: []string{filepath.Join(t.TempDir(), "missing.pem")}}, "Could not read CA bundle"},
+		{"empty CA bundle", &outboundTLS{CAFiles: []string{writeTestFile(t, "empty.pem", "no certificates here")}}, "contains no certificates"},
+		{"missing certificate", &outboundTLS{CertFile: filepath.Join(t.TempDir(), "missing.crt"), KeyFile: keyFile}, "Could not load client certificate"},
+		{"missing key", &outboundTLS{CertFile: certFile, KeyFile: filepath.Join(t.TempDir(), "missing.key")}, "Could not load client certificate"},
+		{"key of another certificate", &outboundTLS{CertFile: certFile, KeyFile: otherKey}, "Could not load client certificate"},
+		{"not a certificate", &outboundTLS{CertFile: keyFile, KeyFile: keyFile}, "Could not load client certificate"},
+	}
+	for _, tt := range tests {
+		if _, err := tt.ot.tlsConfig(); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	tc, err = (&outboundTLS{CertFile: certFile, KeyFile: keyFile}).tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := clientCertificateSubject(t, tc); subject != "client" {
+		t.Fatalf("presents %q", subject)
+	}
+}
+
+func TestClientCertificateReload(t *testing.T) {
+	certFile, keyFile := writeTestKeyPair(t, "first")
+	cc := &clientCertificate{certFile: certFile, keyFile: keyFile}
+	tc := &tls.Config{GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cc.get() }}
+	if subject := clientCertificateSubject(t, tc); subject != "first" {
+		t.Fatalf("presents %q", subject)
+	}
+
+	// The platform rotates the certificate in place
+	rotated, _ := writeTestKeyPair(t, "second")
+	b, err := ioutil.ReadFile(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if subject := clientCertificateSubject(t, tc); subject != "second" {
+		t.Fatalf("presents %q after rotation", subject)
+	}
+
+	// A certificate that goes missing or is half written keeps the last good one
+	if err := ioutil.WriteFile(certFile, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if subject := clientCertificateSubject(t, tc); subject != "second" {
+		t.Fatalf("presents %q after a broken rotation", subject)
+	}
+	os.Remove(certFile)
+	if subject := clientCertificateSubject(t, tc); subject != "second" {
+		t.Fatalf("presents %q after the file was removed", subject)
+	}
+}
+
+// clientCertificateSubject returns the common name of the certificate tc presents.
+func clientCertificateSubject(t *testing.T, tc *tls.Config) string {
+	cert, err := tc.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// idTokenProtocolClaims are ID token claims that only matter to validation
+// and are left out of the user's profile.
+var idTokenProtocolClaims = []string{"nonce", "at_hash", "c_hash"}
+
+// idTokenError reports why an ID token was rejected.
+type idTokenError struct {
+	Claim  string
+	Reason string
+}
+
+func (e *idTokenError) Error() string {
+	if len(e.Claim) == 0 {
+		return "invalid id_token: " + e.Reason
+	}
+	return fmt.Sprintf("invalid id_token %s claim: %s", e.Claim, e.Reason)
+}
+
+// issuerFromEnv returns OIDC_ISSUER, defaulting to UAA's issuer for domain.
+func issuerFromEnv(settings *Settings, domain string) string {
+	if issuer := settings.Get("OIDC_ISSUER"); len(issuer) > 0 {
+		return issuer
+	}
+	return domain + "/oauth/token"
+}
+
+// validateIDToken verifies the signature and the OpenID Connect Core 3.1.3.7
+// claims of an ID token issued to this client. accessToken is used to check
+// at_hash and nonce must match the value sent on the authorize request.
+func validateIDToken(raw string, accessToken string, nonce string, config *authConfig) (*jwt.Token, error) {
+	if len(raw) == 0 {
+		return nil, &idTokenError{Reason: "token response did not include an id_token"}
+	}
+
+	t, err := validateJWT(raw, config, []string{config.ClientID})
+	if err != nil {
+		return nil, &idTokenError{Reason: err.Error()}
+	}
+	claims := t.Claims
+
+	issuer := config.endpoints().Issuer
+	if iss, _ := claims["iss"].(string); iss != issuer {
+		return nil, &idTokenError{"iss", fmt.Sprintf("%q is not the expected issuer %q", iss, issuer)}
+	}
+
+	audiences := claimStrings(claims["aud"])
+	azp, hasAzp := claims["azp"].(string)
+	if len(audiences) > 1 && !hasAzp {
+		return nil, &idTokenError{"azp", "required when the token has several audiences"}
+	}
+	if hasAzp && azp != config.ClientID {
+		return nil, &idTokenError{"azp", fmt.Sprintf("%q is not this client", azp)}
+	}
+
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return nil, &idTokenError{"iat", "missing"}
+	}
+	if time.Unix(int64(iat), 0).After(time.Now().Add(config.Validation.Leeway)) {
+		return nil, &idTokenError{"iat", "issued in the future"}
+	}
+
+	if len(nonce) > 0 {
+		if n, _ := claims["nonce"].(string); n != nonce {
+			return nil, &idTokenError{"nonce", "does not match the login attempt"}
+		}
+	}
+
+	if atHash, ok := claims["at_hash"].(string); ok {
+		expected, err := tokenHash(accessToken, t.Method)
+		if err != nil {
+			return nil, &idTokenError{"at_hash", err.Error()}
+		}
+		if atHash != expected {
+			return nil, &idTokenError{"at_hash", "does not match the access token"}
+		}
+	}
+
+	return t, nil
+}
+
+// tokenHash computes at_hash style values: the left half of the hash of
+// value, using the hash function of the token's signing algorithm.
+func tokenHash(value string, method jwt.SigningMethod) (string, error) {
+	var h crypto.Hash
+	switch m := method.(type) {
+	case *jwt.SigningMethodRSA:
+		h = m.Hash
+	case *jwt.SigningMethodECDSA:
+		h = m.Hash
+	case *jwt.SigningMethodHMAC:
+		h = m.Hash
+	case *jwt.SigningMethodRSAPSS:
+		h = m.Hash
+	default:
+		return "", fmt.Errorf("unsupported algorithm %s", method.Alg())
+	}
+	hasher := h.New()
+	hasher.Write([]byte(value))
+	sum := hasher.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2]), nil
+}
+
+// profileFromClaims copies the identity claims of a validated ID token.
+func profileFromClaims(claims map[string]interface{}) map[string]interface{} {
+	profile := make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		profile[k] = v
+	}
+	for _, k := range idTokenProtocolClaims {
+		delete(profile, k)
+	}
+	return profile
+}
+
+// claimStrings normalizes a claim that may be a single string or an array.
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		var values []string
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	testIssuer   = "https://login.example.com/oauth/token"
+	testClientID = "test-client"
+	testKeyID    = "key-1"
+)
+
+// testSigningKey is the RSA key the test provider signs tokens with.
+var testSigningKey = func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// newTestConfig returns a provider configuration whose key set already holds
+// the public half of testSigningKey.
+func newTestConfig() *authConfig {
+	config := &authConfig{
+		Name:            defaultProviderName,
+		ClientID:        testClientID,
+		ClientSecret:    "test-secret",
+		Domain:          "https://login.example.com",
+		CallbackURL:     "https://app.example.com/callback",
+		staticEndpoints: uaaEndpoints("https://login.example.com", testIssuer),
+		Validation: &tokenValidation{
+			Algorithms:  defaultAlgorithms,
+			CheckIssuer: true,
+			Leeway:      defaultLeeway,
+		},
+		keys: &keySet{
+			url:       func() string { return "" },
+			keys:      map[string]interface{}{testKeyID: &testSigningKey.PublicKey},
+			expires:   time.Now().Add(time.Hour),
+			lastFetch: time.Now(),
+		},
+		HTTPClient:    http.DefaultClient,
+		clientAuth:    &secretBasicAuth{testClientID, "test-secret"},
+		RefreshMargin: defaultRefreshMargin,
+		Redirects:     &redirectPolicy{},
+		Policy:        defaultPolicy,
+	}
+	config.validator = &localJWTValidator{config: config}
+	return config
+}
+
+// signTestToken signs claims with testSigningKey, or with key and method when given.
+func signTestToken(t *testing.T, claims map[string]interface{}, method jwt.SigningMethod, key interface{}) string {
+	if method == nil {
+		method, key = jwt.SigningMethodRS256, testSigningKey
+	}
+	token := jwt.New(method)
+	token.Header["kid"] = testKeyID
+	token.Claims = claims
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// idTokenClaims returns the claims of a valid ID token for the test client.
+func idTokenClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":   testIssuer,
+		"sub":   "user-1",
+		"aud":   testClientID,
+		"iat":   float64(now.Unix()),
+		"exp":   float64(now.Add(time.Hour).Unix()),
+		"nonce": "nonce-1",
+	}
+}
+
+func TestValidateIDToken(t *testing.T) {
+	config := newTestConfig()
+	atHash, _ := tokenHash("access-token", jwt.SigningMethodRS256)
+	publicPEM, _ := x509.MarshalPKIXPublicKey(&testSigningKey.PublicKey)
+	publicKeyBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicPEM})
+
+	tests := []struct {
+		name   string
+		change func(claims map[string]interface{})
+		method jwt.SigningMethod
+		key    interface{}
+		nonce  string
+		err    string
+	}{
+		{name: "valid", nonce: "nonce-1"},
+		{name: "valid at_hash", nonce: "nonce-1", change: func(c map[string]interface{}) { c["at_hash"] = atHash }},
+		{name: "valid azp", nonce: "nonce-1", change: func(c map[string]interface{}) {
+			c["aud"] = []interface{}{testClientID, "other"}
+			c["azp"] = testClientID
+		}},
+		{name: "wrong audience", nonce: "nonce-1", change: func(c map[string]interface{}) { c["aud"] = "other-client" }, err: "audience"},
+		{name: "missing audience", nonce: "nonce-1", change: func(c map[string]interface{}) { delete(c, "aud") }, err: "audience"},
+		{name: "wrong issuer", nonce: "nonce-1", change: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, err: "issuer"},
+		{name: "wrong nonce", nonce: "nonce-2", err: "nonce"},
+		{name: "missing nonce", nonce: "nonce-1", change: func(c map[string]interface{}) { delete(c, "nonce") }, err: "nonce"},
+		{name: "several audiences without azp", nonce: "nonce-1", change: func(c map[string]interface{}) {
+			c["aud"] = []interface{}{testClientID, "other"}
+		}, err: "azp"},
+		{name: "azp for another client", nonce: "nonce-1", change: func(c map[string]interface{}) { c["azp"] = "other" }, err: "azp"},
+		{name: "missing iat", nonce: "nonce-1", change: func(c map[string]interface{}) { delete(c, "iat") }, err: "iat"},
+		{name: "iat in the future", nonce: "nonce-1", change: func(c map[string]interface{}) {
+			c["iat"] = float64(time.Now().Add(time.Hour).Unix())
+		}, err: "iat"},
+		{name: "expired", nonce: "nonce-1", change: func(c map[string]interface{}) {
+			c["exp"] = float64(time.Now().Add(-time.Hour).Unix())
+		}, err: "expired"},
+		{name: "at_hash mismatch", nonce: "nonce-1", change: func(c map[string]interface{}) { c["at_hash"] = "bm90LXRoZS1oYXNo" }, err: "at_hash"},
+		{name: "hmac signed with the public key", nonce: "nonce-1", method: jwt.SigningMethodHS256, key: publicKeyBytes, err: "not allowed"},
+	}
+	for _, tt := range tests {
+		claims := idTokenClaims()
+		if tt.change != nil {
+			tt.change(claims)
+		}
+		raw := signTestToken(t, claims, tt.method, tt.key)
+		_, err := validateIDToken(raw, "access-token", tt.nonce, config)
+		if len(tt.err) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestValidateIDTokenMissing(t *testing.T) {
+	if _, err := validateIDToken("", "access-token", "nonce-1", newTestConfig()); err == nil {
+		t.Fatal("accepted a token response without an id_token")
+	}
+}
+
+func TestProfileFromClaimsDropsProtocolClaims(t *testing.T) {
+	claims := idTokenClaims()
+	claims["at_hash"] = "x"
+	profile := profileFromClaims(claims)
+	if _, ok := profile["nonce"]; ok {
+		t.Error("nonce was copied into the profile")
+	}
+	if _, ok := profile["at_hash"]; ok {
+		t.Error("at_hash was copied into the profile")
+	}
+	if profile["sub"] != "user-1" {
+		t.Errorf("sub = %v", profile["sub"])
+	}
+}
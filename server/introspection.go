@@ -0,0 +1,204 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	defaultIntrospectionTTL = 30 * time.Second
+	maxIntrospectionCache   = 10000
+)
+
+// tokenValidator checks an access token and returns its claims as a
+// *jwt.Token. Deployments pick a strategy with TOKEN_VALIDATION.
+type tokenValidator interface {
+	Validate(token string) (*jwt.Token, error)
+}
+
+// localJWTValidator verifies JWT access tokens with the provider's keys.
+type localJWTValidator struct {
+	config *authConfig
+}
+
+func (v *localJWTValidator) Validate(token string) (*jwt.Token, error) {
+	return validateJWT(token, v.config, v.config.Validation.Audiences)
+}
+
+// introspectionValidator asks the provider about each token, which also
+// works for opaque tokens. It speaks RFC 7662 /introspect as well as UAA's
+// /check_token. Active results are cached briefly.
+type introspectionValidator struct {
+	config   *authConfig
+	endpoint string
+	ttl      time.Duration
+	lock     sync.Mutex
+	cache    map[string]*introspectionResult
+}
+
+type introspectionResult struct {
+	token   *jwt.Token
+	expires time.Time
+}
+
+// tokenValidatorFromEnv selects the strategy named by TOKEN_VALIDATION:
+// "local" (default) or "introspection". INTROSPECTION_ENDPOINT overrides the
+// provider's endpoint, e.g. with UAA's /check_token, and
+// INTROSPECTION_CACHE_TTL sets how long results are reused.
+func tokenValidatorFromEnv(settings *Settings, config *authConfig) (tokenValidator, error) {
+	switch strategy := settings.Get("TOKEN_VALIDATION"); strings.ToLower(strategy) {
+	case "", "local", "jwt":
+		return &localJWTValidator{config: config}, nil
+	case "introspection":
+		iv := &introspectionValidator{
+			config:   config,
+			endpoint: settings.Get("INTROSPECTION_ENDPOINT"),
+			ttl:      defaultIntrospectionTTL,
+			cache:    make(map[string]*introspectionResult),
+		}
+		ttl, err := settings.Duration("INTROSPECTION_CACHE_TTL", defaultIntrospectionTTL)
+		if err != nil {
+			return nil, err
+		}
+		iv.ttl = ttl
+		return iv, nil
+	default:
+		return nil, invalidSetting(settings, "TOKEN_VALIDATION", strategy, "local or introspection")
+	}
+}
+
+func (v *introspectionValidator) Validate(token string) (*jwt.Token, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	v.lock.Lock()
+	cached, ok := v.cache[key]
+	v.lock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.token, nil
+	}
+
+	claims, err := v.introspect(token)
+	if err != nil {
+		return nil, err
+	}
+	t := &jwt.Token{Raw: token, Header: map[string]interface{}{}, Claims: claims, Valid: true}
+	if err := v.check(t); err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(v.ttl)
+	if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(expires) {
+		expires = time.Unix(int64(exp), 0)
+	}
+	v.lock.Lock()
+	if len(v.cache) >= maxIntrospectionCache {
+		for k, r := range v.cache {
+			if time.Now().After(r.expires) {
+				delete(v.cache, k)
+			}
+		}
+	}
+	if len(v.cache) < maxIntrospectionCache {
+		v.cache[key] = &introspectionResult{token: t, expires: expires}
+	}
+	v.lock.Unlock()
+	return t, nil
+}
+
+// check applies the audience and issuer settings to introspected claims.
+func (v *introspectionValidator) check(t *jwt.Token) error {
+	tv := v.config.Validation
+	if iss, ok := t.Claims["iss"].(string); ok && tv.CheckIssuer && iss != v.config.endpoints().Issuer {
+		return &tokenValidationError{tokenIssuer, fmt.Sprintf("issuer %q is not %q", iss, v.config.endpoints().Issuer)}
+	}
+	if len(tv.Audiences) > 0 {
+		for _, aud := range claimStrings(t.Claims["aud"]) {
+			if containsString(tv.Audiences, aud) {
+				return nil
+			}
+		}
+		return &tokenValidationError{tokenAudience, fmt.Sprintf("audience %v does not include any of %v", t.Claims["aud"], tv.Audiences)}
+	}
+	return nil
+}
+
+// introspect posts the token with the client's credentials and returns the
+// claims of an active token.
+func (v *introspectionValidator) introspect(token string) (map[string]interface{}, error) {
+	endpoint := v.endpoint
+	if len(endpoint) == 0 {
+		endpoint = v.config.endpoints().Introspection
+	}
+	if len(endpoint) == 0 {
+		return nil, errors.New("the provider has no introspection endpoint")
+	}
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := v.config.newFormRequest(endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("introspection returned %s: %s", resp.Status, err)
+	}
+	// UAA's /check_token answers 400 with an error for unusable tokens
+	if e, ok := claims["error"].(string); ok {
+		if resp.StatusCode == http.StatusBadRequest && e == "invalid_token" {
+			return nil, &tokenValidationError{tokenInactive, "token is not active"}
+		}
+		return nil, fmt.Errorf("introspection returned %s: %s", resp.Status, e)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection returned %s", resp.Status)
+	}
+	// RFC 7662 requires active to be true. UAA's /check_token omits the field
+	// and signals inactive tokens with the error above.
+	if active, ok := claims["active"]; ok || !isCheckTokenEndpoint(endpoint) {
+		if active != true {
+			return nil, &tokenValidationError{tokenInactive, "token is not active"}
+		}
+	}
+	if exp, ok := claims["exp"].(float64); ok && time.Now().After(time.Unix(int64(exp), 0).Add(v.config.Validation.Leeway)) {
+		return nil, &tokenValidationError{tokenExpired, "token is expired"}
+	}
+
+	// RFC 7662 uses a space separated scope string; UAA an array
+	if scope, ok := claims["scope"].(string); ok {
+		var scopes []interface{}
+		for _, s := range strings.Fields(scope) {
+			scopes = append(scopes, s)
+		}
+		claims["scope"] = scopes
+	}
+	return claims, nil
+}
+
+// isCheckTokenEndpoint reports whether endpoint is UAA's /check_token.
+func isCheckTokenEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err == nil && strings.HasSuffix(strings.TrimRight(u.Path, "/"), "/check_token")
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIntrospect(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		status   int
+		body     string
+		active   bool
+	}{
+		{"active", "/introspect", http.StatusOK, `{"active":true,"sub":"user-1","scope":"test.access"}`, true},
+		{"empty response", "/introspect", http.StatusOK, `{}`, false},
+		{"inactive", "/introspect", http.StatusOK, `{"active":false}`, false},
+		{"active as a string", "/introspect", http.StatusOK, `{"active":"true"}`, false},
+		{"active as a number", "/introspect", http.StatusOK, `{"active":1}`, false},
+		{"error status", "/introspect", http.StatusInternalServerError, `{"active":true}`, false},
+		{"check_token without active", "/check_token", http.StatusOK, `{"sub":"user-1","scope":["test.access"]}`, true},
+		{"check_token inactive", "/check_token", http.StatusOK, `{"active":false}`, false},
+		{"check_token invalid", "/check_token", http.StatusBadRequest, `{"error":"invalid_token"}`, false},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		iv := &introspectionValidator{
+			config:   newTestConfig(),
+			endpoint: ts.URL + tt.endpoint,
+			ttl:      time.Minute,
+			cache:    make(map[string]*introspectionResult),
+		}
+		token, err := iv.Validate("opaque-token")
+		ts.Close()
+		if active := err == nil; active != tt.active {
+			t.Errorf("%s: active = %v, error %v", tt.name, active, err)
+			continue
+		}
+		if tt.active && !hasScope(token, "test.access") {
+			t.Errorf("%s: scopes = %v", tt.name, token.Claims["scope"])
+		}
+	}
+}
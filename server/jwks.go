@@ -0,0 +1,240 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// defaultKeySetTTL applies when the JWKS response carries no cache headers.
+	defaultKeySetTTL = time.Hour
+	// minKeySetRefresh limits how often an unknown kid can trigger a refetch.
+	minKeySetRefresh = 30 * time.Second
+)
+
+var errNoKeyID = errors.New("token has no kid and the key set holds more than one key")
+
+// keyObject is a JSON Web Key as served by UAA's /token_keys or a jwks_uri.
+// UAA also includes the pem-encoded key in Value.
+type keyObject struct {
+	// Kid identifies the key within the set
+	Kid string `json:"kid,omitempty"`
+	// Alg is the encryption algorithm
+	Alg string `json:"alg"`
+	// Value is the actual pem-encoded key used to parse JWT tokens
+	Value string `json:"value"`
+	// Kty is the key type: RSA, EC, or MAC for UAA symmetric keys
+	Kty string `json:"kty,omitempty"`
+	// Use is "sig" for signing keys
+	Use string `json:"use,omitempty"`
+	// N is the RSA modulus
+	N string `json:"n,omitempty"`
+	// E is the RSA public exponent
+	E string `json:"e,omitempty"`
+	// Crv is the EC curve
+	Crv string `json:"crv,omitempty"`
+	// X is the EC x coordinate
+	X string `json:"x,omitempty"`
+	// Y is the EC y coordinate
+	Y string `json:"y,omitempty"`
+}
+
+// publicKey converts the JWK into *rsa.PublicKey, *ecdsa.PublicKey or, for
+// UAA MAC keys, the []byte secret.
+func (ko *keyObject) publicKey() (interface{}, error) {
+	switch ko.Kty {
+	case "RSA":
+		if len(ko.N) > 0 && len(ko.E) > 0 {
+			n, err := decodeKeyInt(ko.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := decodeKeyInt(ko.E)
+			if err != nil {
+				return nil, err
+			}
+			return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+		}
+		return jwt.ParseRSAPublicKeyFromPEM([]byte(ko.Value))
+	case "EC":
+		var curve elliptic.Curve
+		switch ko.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", ko.Crv)
+		}
+		x, err := decodeKeyInt(ko.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeKeyInt(ko.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "MAC", "oct":
+		if len(ko.Value) == 0 {
+			return nil, errors.New("symmetric key has no value")
+		}
+		return []byte(ko.Value), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", ko.Kty)
+}
+
+func decodeKeyInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keySet caches the IdP's signing keys by kid. Keys are refetched when the
+// cache expires, as set by the response's Cache-Control or Expires headers,
+// or when a token names a kid that is not in the set.
+type keySet struct {
+	url       func() string
+	client    *http.Client
+	lock      sync.Mutex
+	keys      map[string]interface{}
+	expires   time.Time
+	lastFetch time.Time
+}
+
+func newKeySet(url func() string, client *http.Client) *keySet {
+	return &keySet{url: url, client: client}
+}
+
+// key returns the key with the given kid. An empty kid is accepted only when
+// the set holds a single key.
+func (ks *keySet) key(kid string) (interface{}, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	stale := ks.keys == nil || time.Now().After(ks.expires)
+	if stale && (ks.lastFetch.IsZero() || time.Since(ks.lastFetch) >= minKeySetRefresh) {
+		if err := ks.refresh(); err != nil && ks.keys == nil {
+			return nil, err
+		}
+	}
+	if key, ok := ks.lookup(kid); ok {
+		return key, nil
+	}
+
+	// An unknown kid may mean the IdP rotated its keys
+	if time.Since(ks.lastFetch) >= minKeySetRefresh {
+		if err := ks.refresh(); err != nil {
+			return nil, err
+		}
+		if key, ok := ks.lookup(kid); ok {
+			return key, nil
+		}
+	}
+	if len(kid) == 0 {
+		return nil, errNoKeyID
+	}
+	return nil, fmt.Errorf("no signing key with kid %q", kid)
+}
+
+func (ks *keySet) lookup(kid string) (interface{}, bool) {
+	if len(kid) == 0 && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// refresh must be called with the lock held. On failure the cached keys are
+// left in place.
+func (ks *keySet) refresh() error {
+	ks.lastFetch = time.Now()
+
+	resp, err := ks.client.Get(ks.url())
+	if err != nil {
+		fmt.Printf("Error retrieving signing keys: %s\n", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("signing key request returned %s", resp.Status)
+		fmt.Println(err)
+		return err
+	}
+
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []keyObject `json:"keys"`
+	}
+	if err := json.Unmarshal(payload, &set); err != nil {
+		fmt.Printf("Error parsing signing keys: %s\n", err)
+		return err
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for i := range set.Keys {
+		ko := &set.Keys[i]
+		if len(ko.Use) > 0 && ko.Use != "sig" {
+			continue
+		}
+		key, err := ko.publicKey()
+		if err != nil {
+			fmt.Printf("Skipping signing key %q: %s\n", ko.Kid, err)
+			continue
+		}
+		keys[ko.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("key set contains no usable signing keys")
+	}
+
+	ks.keys = keys
+	ks.expires = time.Now().Add(cacheLifetime(resp.Header))
+	fmt.Printf("Retrieved %d signing keys, cached until %s\n", len(keys), ks.expires.Format(time.RFC3339))
+	return nil
+}
+
+// cacheLifetime reads max-age or Expires from the response headers.
+func cacheLifetime(h http.Header) time.Duration {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		return expires.Sub(time.Now())
+	}
+	return defaultKeySetTTL
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rsaJWK returns the JSON Web Key of key under kid.
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kid": kid,
+		"kty": "RSA",
+		"alg": "RS256",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// jwksServer serves the keys it holds and counts the requests.
+type jwksServer struct {
+	*httptest.Server
+	lock         sync.Mutex
+	keys         []map[string]string
+	cacheControl string
+	fetches      int
+}
+
+func newJWKSServer(keys ...map[string]string) *jwksServer {
+	js := &jwksServer{keys: keys}
+	js.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		js.lock.Lock()
+		defer js.lock.Unlock()
+		js.fetches++
+		if len(js.cacheControl) > 0 {
+			w.Header().Set("Cache-Control", js.cacheControl)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": js.keys})
+	}))
+	return js
+}
+
+func (js *jwksServer) serve(keys ...map[string]string) {
+	js.lock.Lock()
+	js.keys = keys
+	js.lock.Unlock()
+}
+
+func TestKeySetRotation(t *testing.T) {
+	js := newJWKSServer(rsaJWK("k1", &testSigningKey.PublicKey))
+	defer js.Close()
+	ks := newKeySet(func() string { return js.URL }, http.DefaultClient)
+
+	if _, err := ks.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.key("k1"); err != nil || js.fetches != 1 {
+		t.Fatalf("cached key: error %v, %d fetches", err, js.fetches)
+	}
+
+	// The IdP rotates to k2; an unknown kid refetches at most every minKeySetRefresh
+	js.serve(rsaJWK("k2", &partnerSigningKey.PublicKey))
+	if _, err := ks.key("k2"); err == nil || js.fetches != 1 {
+		t.Fatalf("refetched within the rate limit: error %v, %d fetches", err, js.fetches)
+	}
+	ks.lastFetch = ks.lastFetch.Add(-minKeySetRefresh)
+	key, err := ks.key("k2")
+	if err != nil || js.fetches != 2 {
+		t.Fatalf("rotated key: error %v, %d fetches", err, js.fetches)
+	}
+	if key.(*rsa.PublicKey).N.Cmp(partnerSigningKey.N) != 0 {
+		t.Fatal("got the wrong key for k2")
+	}
+	if _, err := ks.key("k1"); err == nil {
+		t.Fatal("the retired key k1 is still accepted")
+	}
+
+	// A token naming a key that never existed does not hammer the IdP
+	ks.lastFetch = ks.lastFetch.Add(-minKeySetRefresh)
+	for i := 0; i < 3; i++ {
+		if _, err := ks.key("unknown"); err == nil {
+			t.Fatal("accepted an unknown kid")
+		}
+	}
+	if js.fetches != 3 {
+		t.Fatalf("%d fetches for unknown kids, want one", js.fetches-2)
+	}
+}
+
+func TestKeySetWithoutKeyID(t *testing.T) {
+	js := newJWKSServer(rsaJWK("k1", &testSigningKey.PublicKey))
+	defer js.Close()
+	ks := newKeySet(func() string { return js.URL }, http.DefaultClient)
+	if _, err := ks.key(""); err != nil {
+		t.Fatalf("single key without kid: %v", err)
+	}
+
+	js.serve(rsaJWK("k1", &testSigningKey.PublicKey), rsaJWK("k2", &partnerSigningKey.PublicKey))
+	ks.expires = time.Now().Add(-time.Second)
+	ks.lastFetch = ks.lastFetch.Add(-minKeySetRefresh)
+	if _, err := ks.key(""); err != errNoKeyID {
+		t.Fatalf("several keys without kid: error = %v", err)
+	}
+}
+
+func TestKeySetCacheLifetime(t *testing.T) {
+	js := newJWKSServer(rsaJWK("k1", &testSigningKey.PublicKey))
+	defer js.Close()
+	js.cacheControl = "public, max-age=120"
+	ks := newKeySet(func() string { return js.URL }, http.DefaultClient)
+	if _, err := ks.key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := ks.expires.Sub(time.Now()); ttl < 110*time.Second || ttl > 120*time.Second {
+		t.Fatalf("cached for %s, want 120s", ttl)
+	}
+
+	// Once expired the set is refetched, even for a known kid
+	ks.expires = time.Now().Add(-time.Second)
+	ks.lastFetch = ks.lastFetch.Add(-minKeySetRefresh)
+	if _, err := ks.key("k1"); err != nil || js.fetches != 2 {
+		t.Fatalf("expired set: error %v, %d fetches", err, js.fetches)
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		expires      string
+		want         time.Duration
+	}{
+		{"max-age=60", "", time.Minute},
+		{"public, Max-Age=300", "", 5 * time.Minute},
+		{"no-store", "", 0},
+		{"no-cache, max-age=60", "", 0},
+		{"max-age=soon", "", defaultKeySetTTL},
+		{"", time.Now().Add(10 * time.Minute).UTC().Format(http.TimeFormat), 10 * time.Minute},
+		{"", "", defaultKeySetTTL},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if len(tt.cacheControl) > 0 {
+			h.Set("Cache-Control", tt.cacheControl)
+		}
+		if len(tt.expires) > 0 {
+			h.Set("Expires", tt.expires)
+		}
+		got := cacheLifetime(h)
+		if diff := got - tt.want; diff > time.Second || diff < -time.Second {
+			t.Errorf("%q %q: lifetime %s, want %s", tt.cacheControl, tt.expires, got, tt.want)
+		}
+	}
+}
@@ -1,47 +1,262 @@
 package server
 
 import (
-	"errors"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
+const defaultLeeway = time.Minute
+
+var defaultAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+// tokenErrorKind classifies why a JWT was rejected so handlers can react,
+// e.g. by refreshing an expired token instead of denying access.
+type tokenErrorKind int
+
+const (
+	tokenMalformed tokenErrorKind = iota
+	tokenAlgorithm
+	tokenKey
+	tokenSignature
+	tokenExpired
+	tokenNotYetValid
+	tokenIssuer
+	tokenAudience
+	tokenInactive
+	tokenBinding
+)
+
+// tokenValidationError is returned by parseToken for every rejected token.
+type tokenValidationError struct {
+	Kind   tokenErrorKind
+	Reason string
+}
+
+func (e *tokenValidationError) Error() string {
+	return "invalid token: " + e.Reason
+}
+
+// isTokenError reports whether err is a tokenValidationError of the given kind.
+func isTokenError(err error, kind tokenErrorKind) bool {
+	te, ok := err.(*tokenValidationError)
+	return ok && te.Kind == kind
+}
+
+// tokenValidation holds the checks applied to every JWT the app accepts.
+type tokenValidation struct {
+	// Algorithms is the allow-list of signing algorithms; "none" is never allowed
+	Algorithms []string
+	// CheckIssuer requires iss to equal the provider's issuer
+	CheckIssuer bool
+	// Audiences, when set, requires aud to contain at least one of them
+	Audiences []string
+	// Leeway is the clock skew tolerated for exp and nbf
+	Leeway time.Duration
+}
+
+// tokenValidationFromEnv reads JWT_ALGORITHMS, JWT_AUDIENCE,
+// JWT_VALIDATE_ISSUER and JWT_LEEWAY.
+func tokenValidationFromEnv(settings *Settings) (*tokenValidation, error) {
+	tv := &tokenValidation{
+		Algorithms:  defaultAlgorithms,
+		CheckIssuer: true,
+		Audiences:   splitList(settings.Get("JWT_AUDIENCE")),
+		Leeway:      defaultLeeway,
+	}
+	if algs := splitList(settings.Get("JWT_ALGORITHMS")); len(algs) > 0 {
+		for _, alg := range algs {
+			if strings.EqualFold(alg, "none") || jwt.GetSigningMethod(alg) == nil {
+				return nil, invalidSetting(settings, "JWT_ALGORITHMS", alg, "supported signing algorithms such as RS256")
+			}
+		}
+		tv.Algorithms = algs
+	}
+	var err error
+	if tv.CheckIssuer, err = settings.Bool("JWT_VALIDATE_ISSUER", tv.CheckIssuer); err != nil {
+		return nil, err
+	}
+	if tv.Leeway, err = settings.Duration("JWT_LEEWAY", defaultLeeway); err != nil {
+		return nil, err
+	}
+	return tv, nil
+}
+
+// parseToken validates an access token with the configured strategy.
 func parseToken(token string, config *authConfig) (t *jwt.Token, err error) {
-	tokenKey, err := config.getTokenKey()
-	if err != nil {
+	if t, err = config.validator.Validate(token); err != nil {
 		return nil, err
 	}
+	return config.restrictScopes(t), nil
+}
 
+// restrictScopes returns t with its scope claim limited to the scopes the
+// provider may grant, so no later scope check sees the others.
+func (ac *authConfig) restrictScopes(t *jwt.Token) *jwt.Token {
+	if ac.AllowedScopes == nil {
+		return t
+	}
+	var scopes []interface{}
+	for _, scope := range claimStrings(t.Claims["scope"]) {
+		if containsString(ac.AllowedScopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	// Copy the claims, which the introspection cache may share
+	claims := make(map[string]interface{}, len(t.Claims))
+	for k, v := range t.Claims {
+		claims[k] = v
+	}
+	claims["scope"] = scopes
+	restricted := *t
+	restricted.Claims = claims
+	return &restricted
+}
+
+// validateJWT verifies the signature of raw with an allowed algorithm and
+// checks exp, nbf, iss and, when audiences is not empty, aud.
+func validateJWT(raw string, config *authConfig, audiences []string) (*jwt.Token, error) {
+	tv := config.Validation
+
+	// jwt-go flattens keyFunc errors into strings, so keep the typed one aside
+	var keyErr *tokenValidationError
 	keyFunc := func(t *jwt.Token) (interface{}, error) {
-		return []byte(tokenKey), nil
+		key, err := signingKey(t, config)
+		if err != nil {
+			keyErr = err
+			return nil, err
+		}
+		return key, nil
 	}
 
-	t, err = jwt.Parse(token, keyFunc)
+	t, err := jwt.Parse(raw, keyFunc)
+	if keyErr != nil {
+		return nil, keyErr
+	}
 	if err != nil {
-		return nil, err
+		ve, ok := err.(*jwt.ValidationError)
+		if !ok {
+			return nil, &tokenValidationError{tokenMalformed, err.Error()}
+		}
+		switch {
+		case ve.Errors&jwt.ValidationErrorMalformed != 0:
+			return nil, &tokenValidationError{tokenMalformed, ve.Error()}
+		case ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+			return nil, &tokenValidationError{tokenAlgorithm, ve.Error()}
+		case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+			return nil, &tokenValidationError{tokenSignature, ve.Error()}
+		}
+		// exp and nbf failures are rechecked below with leeway
 	}
 
-	if !t.Valid {
-		err = errors.New("Token is not valid")
-		return nil, err
+	claims := t.Claims
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, &tokenValidationError{tokenExpired, "exp claim is missing"}
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(tv.Leeway)) {
+		return nil, &tokenValidationError{tokenExpired, "token is expired"}
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(tv.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, &tokenValidationError{tokenNotYetValid, "token is not valid yet"}
+	}
+
+	if tv.CheckIssuer {
+		issuer := config.endpoints().Issuer
+		if iss, _ := claims["iss"].(string); iss != issuer {
+			return nil, &tokenValidationError{tokenIssuer, fmt.Sprintf("issuer %q is not %q", iss, issuer)}
+		}
+	}
+
+	if len(audiences) > 0 {
+		found := false
+		for _, aud := range claimStrings(claims["aud"]) {
+			if containsString(audiences, aud) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, &tokenValidationError{tokenAudience, fmt.Sprintf("audience %v does not include any of %v", claims["aud"], audiences)}
+		}
 	}
 
+	t.Valid = true
 	return t, nil
 }
 
-func hasScope(token *jwt.Token, desiredScopes ...string) bool {
-	scopeFound := false
+// signingKey checks the token's alg against the allow-list and returns the
+// IdP key named by its kid, provided the key type fits the algorithm.
+func signingKey(t *jwt.Token, config *authConfig) (interface{}, *tokenValidationError) {
+	alg := t.Method.Alg()
+	if strings.EqualFold(alg, "none") || !containsString(config.Validation.Algorithms, alg) {
+		return nil, &tokenValidationError{tokenAlgorithm, fmt.Sprintf("signing algorithm %s is not allowed", alg)}
+	}
+	kid, _ := t.Header["kid"].(string)
+	key, err := config.keys.key(kid)
+	if err != nil {
+		return nil, &tokenValidationError{tokenKey, err.Error()}
+	}
+	if err := checkKeyType(t.Method, key); err != nil {
+		return nil, &tokenValidationError{tokenAlgorithm, err.Error()}
+	}
+	return key, nil
+}
 
-	scopes := token.Claims["scope"]
-	a := scopes.([]interface{})
+// checkKeyType rejects alg/key combinations such as an HMAC token verified
+// with an RSA public key's bytes.
+func checkKeyType(method jwt.SigningMethod, key interface{}) error {
+	ok := false
+	switch m := method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok = key.(*rsa.PublicKey)
+	case *jwt.SigningMethodECDSA:
+		var k *ecdsa.PublicKey
+		if k, ok = key.(*ecdsa.PublicKey); ok {
+			ok = k.Curve.Params().BitSize == m.CurveBits
+		}
+	case *jwt.SigningMethodHMAC:
+		_, ok = key.([]byte)
+	}
+	if !ok {
+		return fmt.Errorf("algorithm %s does not match the key type %T", method.Alg(), key)
+	}
+	return nil
+}
 
-	for _, scope := range a {
-		for _, desiredScope := range desiredScopes {
-			if scope.(string) == desiredScope {
-				scopeFound = true
-				break
-			}
+// splitList splits a comma separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// hasScope reports whether the token carries any of desiredScopes.
+func hasScope(token *jwt.Token, desiredScopes ...string) bool {
+	for _, scope := range claimStrings(token.Claims["scope"]) {
+		if containsString(desiredScopes, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAllScopes reports whether the token carries every one of desiredScopes.
+func hasAllScopes(token *jwt.Token, desiredScopes ...string) bool {
+	scopes := claimStrings(token.Claims["scope"])
+	for _, desiredScope := range desiredScopes {
+		if !containsString(scopes, desiredScope) {
+			return false
 		}
 	}
-	return scopeFound
+	return true
 }
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// accessTokenClaims returns the claims of a valid access token.
+func accessTokenClaims(scopes ...string) map[string]interface{} {
+	scope := make([]interface{}, len(scopes))
+	for i, s := range scopes {
+		scope[i] = s
+	}
+	return map[string]interface{}{
+		"iss":   testIssuer,
+		"sub":   "user-1",
+		"aud":   []interface{}{"test", testClientID},
+		"exp":   float64(time.Now().Add(time.Hour).Unix()),
+		"scope": scope,
+	}
+}
+
+// unsignedToken builds a token with alg none, which jwt-go cannot produce.
+func unsignedToken(claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + enc([]byte(claims)) + "."
+}
+
+func TestValidateJWT(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	hmacSecret := []byte("a shared secret that is long enough")
+
+	tests := []struct {
+		name      string
+		change    func(claims map[string]interface{})
+		method    jwt.SigningMethod
+		key       interface{}
+		raw       string
+		audiences []string
+		kind      tokenErrorKind
+		ok        bool
+	}{
+		{name: "valid", ok: true},
+		{name: "valid audience", audiences: []string{"other", "test"}, ok: true},
+		{name: "expired within leeway", change: func(c map[string]interface{}) {
+			c["exp"] = float64(time.Now().Add(-30 * time.Second).Unix())
+		}, ok: true},
+		{name: "expired", change: func(c map[string]interface{}) {
+			c["exp"] = float64(time.Now().Add(-2 * defaultLeeway).Unix())
+		}, kind: tokenExpired},
+		{name: "missing exp", change: func(c map[string]interface{}) { delete(c, "exp") }, kind: tokenExpired},
+		{name: "not yet valid", change: func(c map[string]interface{}) {
+			c["nbf"] = float64(time.Now().Add(2 * defaultLeeway).Unix())
+		}, kind: tokenNotYetValid},
+		{name: "wrong issuer", change: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, kind: tokenIssuer},
+		{name: "wrong audience", audiences: []string{"billing"}, kind: tokenAudience},
+		{name: "alg none", raw: unsignedToken(`{"iss":"` + testIssuer + `","exp":9999999999}`), kind: tokenAlgorithm},
+		{name: "hmac alg not allowed", method: jwt.SigningMethodHS256, key: hmacSecret, kind: tokenAlgorithm},
+		{name: "ecdsa signature for an rsa key", method: jwt.SigningMethodES256, key: ecKey, kind: tokenAlgorithm},
+		{name: "rs384 signature checked as rs256", raw: resign(t, jwt.SigningMethodRS384, "RS256"), kind: tokenSignature},
+		{name: "tampered payload", raw: tamper(signTestToken(t, accessTokenClaims(), nil, nil)), kind: tokenSignature},
+		{name: "malformed", raw: "not.a.jwt", kind: tokenMalformed},
+	}
+	for _, tt := range tests {
+		config := newTestConfig()
+		raw := tt.raw
+		if len(raw) == 0 {
+			claims := accessTokenClaims("test.access")
+			if tt.change != nil {
+				tt.change(claims)
+			}
+			raw = signTestToken(t, claims, tt.method, tt.key)
+		}
+		_, err := validateJWT(raw, config, tt.audiences)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if !isTokenError(err, tt.kind) {
+			t.Errorf("%s: error = %#v, want kind %d", tt.name, err, tt.kind)
+		}
+	}
+}
+
+// resign signs a token with method but labels it alg in the header.
+func resign(t *testing.T, method jwt.SigningMethod, alg string) string {
+	token := jwt.New(method)
+	token.Header["kid"] = testKeyID
+	token.Header["alg"] = alg
+	token.Claims = accessTokenClaims()
+	raw, err := token.SignedString(testSigningKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// tamper replaces the payload of raw with claims granting more scopes.
+func tamper(raw string) string {
+	parts := strings.Split(raw, ".")
+	claims := `{"iss":"` + testIssuer + `","exp":9999999999,"scope":["test.admin"]}`
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(claims))
+	return strings.Join(parts, ".")
+}
+
+func TestValidateJWTUnknownKey(t *testing.T) {
+	config := newTestConfig()
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Header["kid"] = "rotated-away"
+	token.Claims = accessTokenClaims()
+	raw, _ := token.SignedString(testSigningKey)
+	if _, err := validateJWT(raw, config, nil); !isTokenError(err, tokenKey) {
+		t.Fatalf("error = %v, want an unknown key error", err)
+	}
+}
+
+func TestCheckKeyType(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		key    interface{}
+		ok     bool
+	}{
+		{"rsa key for RS256", jwt.SigningMethodRS256, &testSigningKey.PublicKey, true},
+		{"rsa key for PS256", jwt.SigningMethodPS256, &testSigningKey.PublicKey, true},
+		{"P-256 key for ES256", jwt.SigningMethodES256, &p256.PublicKey, true},
+		{"P-384 key for ES256", jwt.SigningMethodES256, &p384.PublicKey, false},
+		{"rsa key for ES256", jwt.SigningMethodES256, &testSigningKey.PublicKey, false},
+		{"rsa key bytes for HS256", jwt.SigningMethodHS256, &testSigningKey.PublicKey, false},
+		{"secret for HS256", jwt.SigningMethodHS256, []byte("secret"), true},
+		{"secret for RS256", jwt.SigningMethodRS256, []byte("secret"), false},
+	}
+	for _, tt := range tests {
+		if err := checkKeyType(tt.method, tt.key); (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v", tt.name, err)
+		}
+	}
+}
+
+func TestTokenValidationFromEnv(t *testing.T) {
+	tests := []struct {
+		env map[string]string
+		ok  bool
+	}{
+		{map[string]string{}, true},
+		{map[string]string{"JWT_ALGORITHMS": "RS256, ES256"}, true},
+		{map[string]string{"JWT_ALGORITHMS": "RS256,none"}, false},
+		{map[string]string{"JWT_ALGORITHMS": "XS999"}, false},
+		{map[string]string{"JWT_LEEWAY": "-1s"}, false},
+		{map[string]string{"JWT_VALIDATE_ISSUER": "sometimes"}, false},
+	}
+	for _, tt := range tests {
+		if _, err := tokenValidationFromEnv(newTestSettings(tt.env)); (err == nil) != tt.ok {
+			t.Errorf("%v: error = %v", tt.env, err)
+		}
+	}
+}
+
+func TestScopes(t *testing.T) {
+	token := &jwt.Token{Claims: accessTokenClaims("test.access", "test.read")}
+	if !hasScope(token, "test.admin", "test.access") {
+		t.Error("hasScope missed test.access")
+	}
+	if hasScope(token, "test.admin") {
+		t.Error("hasScope found test.admin")
+	}
+	if !hasAllScopes(token, "test.access", "test.read") || hasAllScopes(token, "test.access", "test.admin") {
+		t.Error("hasAllScopes is wrong")
+	}
+}
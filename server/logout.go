@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/astaxie/beego/session"
+)
+
+// logoutConfig controls what /logout does besides clearing the session.
+type logoutConfig struct {
+	// LandingURL is where the user ends up after logging out
+	LandingURL string
+	// RevokeTokens revokes the session's tokens at the provider
+	RevokeTokens bool
+	// EndSession redirects through the provider's end_session endpoint
+	EndSession bool
+}
+
+// logoutConfigFromEnv reads LOGOUT_LANDING_URL, LOGOUT_REVOKE_TOKENS and
+// LOGOUT_END_SESSION. A relative landing page is resolved against the
+// callback url, because the provider needs an absolute url to return to.
+func logoutConfigFromEnv(settings *Settings, callbackURL string) (*logoutConfig, error) {
+	lc := &logoutConfig{LandingURL: "/", EndSession: true}
+	if landing := settings.Get("LOGOUT_LANDING_URL"); len(landing) > 0 {
+		lc.LandingURL = landing
+	}
+	if base, err := url.Parse(callbackURL); err == nil {
+		if landing, err := base.Parse(lc.LandingURL); err == nil {
+			lc.LandingURL = landing.String()
+		}
+	}
+
+	var err error
+	if lc.RevokeTokens, err = settings.Bool("LOGOUT_REVOKE_TOKENS", lc.RevokeTokens); err != nil {
+		return nil, err
+	}
+	if lc.EndSession, err = settings.Bool("LOGOUT_END_SESSION", lc.EndSession); err != nil {
+		return nil, err
+	}
+	return lc, nil
+}
+
+// logoutHandler destroys the session, optionally revokes its tokens and
+// sends the browser through the provider's end_session endpoint.
+func logoutHandler(sessionManager *session.Manager, config *authConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := startSession(sessionManager, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonToken, _ := session.Get("token").(string)
+		idToken, _ := session.Get("id_token").(string)
+		profile, _ := session.Get("profile").(map[string]interface{})
+		provider := config.forSession(session)
+		provider.Exchange.forgetSessionUser(session)
+		session.Flush()
+		releaseSession(w, session)
+		destroySession(sessionManager, w, r)
+
+		config.SessionIndex.remove(session.SessionID(), profile)
+		if config.Logout.RevokeTokens && len(jsonToken) > 0 {
+			ctx, cancel := requestContext(w, revocationTimeout)
+			revokeSessionTokens(ctx, provider, jsonToken)
+			cancel()
+		}
+
+		provider.redirect(w, r, endSessionURL(provider, idToken))
+	}
+}
+
+// endSessionURL returns the provider logout url that returns to the landing
+// page, or the landing page itself when the provider has no such endpoint.
+func endSessionURL(config *authConfig, idToken string) string {
+	endpoint := config.endpoints().EndSession
+	if !config.Logout.EndSession || len(endpoint) == 0 {
+		return config.Logout.LandingURL
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		fmt.Printf("Invalid end_session endpoint %q: %s\n", endpoint, err)
+		return config.Logout.LandingURL
+	}
+
+	q := u.Query()
+	q.Set("post_logout_redirect_uri", config.Logout.LandingURL)
+	q.Set("client_id", config.ClientID)
+	if len(idToken) > 0 {
+		q.Set("id_token_hint", idToken)
+	}
+	if config.discovery == nil {
+		// UAA's /logout.do predates the OpenID parameters
+		q.Set("redirect", config.Logout.LandingURL)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
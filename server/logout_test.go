@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEndSessionURL(t *testing.T) {
+	const landing = "https://app.example.com/goodbye"
+	discovered := func(endpoint string) *providerDiscovery {
+		return &providerDiscovery{
+			Refresh:   time.Hour,
+			endpoints: &providerEndpoints{EndSession: endpoint},
+			fetched:   time.Now(),
+		}
+	}
+	tests := []struct {
+		name       string
+		discovery  *providerDiscovery
+		endSession bool
+		idToken    string
+		want       string
+		query      url.Values
+	}{
+		{
+			name:       "openid provider",
+			discovery:  discovered("https://idp.example.com/logout?ui=full"),
+			endSession: true,
+			idToken:    "id-token",
+			want:       "https://idp.example.com/logout",
+			query: url.Values{
+				"ui":                       {"full"},
+				"id_token_hint":            {"id-token"},
+				"post_logout_redirect_uri": {landing},
+				"client_id":                {testClientID},
+			},
+		},
+		{
+			name:       "no id token",
+			discovery:  discovered("https://idp.example.com/logout"),
+			endSession: true,
+			want:       "https://idp.example.com/logout",
+			query: url.Values{
+				"post_logout_redirect_uri": {landing},
+				"client_id":                {testClientID},
+			},
+		},
+		{
+			name:       "uaa",
+			endSession: true,
+			idToken:    "id-token",
+			want:       "https://login.example.com/logout.do",
+			query: url.Values{
+				"id_token_hint":            {"id-token"},
+				"post_logout_redirect_uri": {landing},
+				"client_id":                {testClientID},
+				"redirect":                 {landing},
+			},
+		},
+		{name: "no end_session endpoint", discovery: discovered(""), endSession: true, idToken: "id-token", want: landing},
+		{name: "end session disabled", idToken: "id-token", want: landing},
+		{name: "invalid endpoint", discovery: discovered("https://idp.example.com/%zz"), endSession: true, want: landing},
+	}
+	for _, tt := range tests {
+		config := newTestConfig()
+		config.discovery = tt.discovery
+		config.Logout = &logoutConfig{LandingURL: landing, EndSession: tt.endSession}
+
+		u, err := url.Parse(endSessionURL(config, tt.idToken))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		query := u.Query()
+		u.RawQuery = ""
+		if u.String() != tt.want {
+			t.Errorf("%s: redirected to %s, want %s", tt.name, u, tt.want)
+		}
+		if tt.query == nil {
+			tt.query = url.Values{}
+		}
+		if !reflect.DeepEqual(query, tt.query) {
+			t.Errorf("%s: query %v, want %v", tt.name, query, tt.query)
+		}
+	}
+}
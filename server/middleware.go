@@ -1,21 +1,81 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
 
 	"github.com/astaxie/beego/session"
 	"github.com/codegangsta/negroni"
 )
 
-func isAuthenticated(sessionManager *session.Manager) negroni.HandlerFunc {
+// isAuthenticated starts a login for visitors without a session. Page loads
+// return to the requested URL once the login completes; other requests are
+// refused.
+func isAuthenticated(sessionManager *session.Manager, config *authConfig) negroni.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 
-		session, _ := sessionManager.SessionStart(w, r)
-		defer session.SessionRelease(w)
-		if session.Get("token") == nil {
-			http.Redirect(w, r, "/", http.StatusMovedPermanently)
-		} else {
+		session, err := startSession(sessionManager, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hasToken := session.Get("token") != nil
+		if hasToken {
+			profile, _ := session.Get("profile").(map[string]interface{})
+			config.SessionIndex.touch(session.SessionID(), profile)
+		}
+		if err := releaseSession(w, session); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hasToken {
 			next(w, r)
+			return
+		}
+		if r.Method == "GET" || r.Method == "HEAD" {
+			if len(config.Providers.list) > 1 {
+				config.redirect(w, r, "/login?rd="+url.QueryEscape(r.URL.RequestURI()))
+				return
+			}
+			startLogin(sessionManager, config, w, r, r.URL.RequestURI())
+			return
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// refreshSessionToken refreshes the session's access token before it expires.
+// When the provider rejects the refresh the session is destroyed and the user
+// is sent back to log in; transient failures leave the session alone. The
+// refreshed token is kept in the request's session store for the handlers
+// that follow.
+func refreshSessionToken(sessionManager *session.Manager, config *authConfig) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+
+		session, err := startSession(sessionManager, w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = sessionToken(sessionManager, session, config.forSession(session))
+		if err == nil {
+			if err := releaseSession(w, session); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err != nil && !refreshRejected(err) {
+			fmt.Printf("Could not refresh token: %s\n", err)
+			errorPage(w, http.StatusServiceUnavailable, "Service Unavailable", "Your session could not be renewed right now. Please try again shortly.")
+			return
+		}
+		if err != nil {
+			fmt.Printf("Could not refresh token, logging out: %s\n", err)
+			destroySession(sessionManager, w, r)
+			config.redirect(w, r, "/")
+			return
 		}
+		next(w, r)
 	}
 }
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+	"golang.org/x/oauth2"
+)
+
+func TestRefreshWithCookieSessions(t *testing.T) {
+	config := newTestConfig()
+	config.Providers = &providerRegistry{list: []*authConfig{config}, byName: map[string]*authConfig{config.Name: config}}
+	config.SessionIndex = newSessionIndex(&sessionConfig{Provider: "cookie"})
+	refreshes := 0
+	ts := newTokenServer(config, func(w http.ResponseWriter, r *http.Request) {
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"` + signTestToken(t, accessTokenClaims("test.admin"), nil, nil) +
+			`","token_type":"bearer","refresh_token":"rt-2","expires_in":3600}`))
+	})
+	defer ts.Close()
+	sm, err := newSessionManager(&sessionConfig{Provider: "cookie", Lifetime: 3600, HashKey: "test-hash-key", BlockKey: "0123456789abcdef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := negroni.New(
+		negroni.HandlerFunc(isAuthenticated(sm, config)),
+		negroni.HandlerFunc(refreshSessionToken(sm, config)),
+		negroni.HandlerFunc(authorize(sm, config)),
+		negroni.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _, err := tokenFromSession(sm, w, r, config)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			w.Write([]byte(token.RefreshToken))
+		})),
+	)
+
+	r := loggedInRequest(t, sm, "GET", "/protected/admin", &oauth2.Token{
+		AccessToken:  "expired",
+		RefreshToken: "rt-1",
+		Expiry:       time.Now().Add(-time.Minute),
+	})
+	defer context.Clear(r)
+	w := httptest.NewRecorder()
+	chain.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "rt-2" {
+		t.Fatalf("status %d, body %q", w.Code, w.Body.String())
+	}
+	written := 0
+	for _, cookie := range w.HeaderMap["Set-Cookie"] {
+		if strings.HasPrefix(cookie, sessionCookieName+"=") {
+			written++
+		}
+	}
+	if written != 1 {
+		t.Fatalf("session cookie written %d times", written)
+	}
+
+	// The browser keeps the refreshed session, so the next request needs no refresh
+	r = httptest.NewRequest("GET", "/protected/admin", nil)
+	defer context.Clear(r)
+	r.AddCookie(sessionCookie(t, w))
+	w = httptest.NewRecorder()
+	chain.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "rt-2" || refreshes != 1 {
+		t.Fatalf("status %d, body %q after %d refreshes", w.Code, w.Body.String(), refreshes)
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var errNoClientCertificate = errors.New("the request did not present a client certificate")
+
+// hasClientCertificate reports whether client presents a TLS client certificate.
+func hasClientCertificate(client *http.Client) bool {
+	tr, ok := client.Transport.(*http.Transport)
+	return ok && tr.TLSClientConfig != nil && tr.TLSClientConfig.GetClientCertificate != nil
+}
+
+// tokenURL returns the token endpoint, using the provider's mTLS alias when
+// authenticating with a client certificate.
+func (ac *authConfig) tokenURL() string {
+	endpoints := ac.endpoints()
+	if ac.ClientAuthMethod == tlsClientAuth && endpoints.MTLSAliases != nil && len(endpoints.MTLSAliases.Token) > 0 {
+		return endpoints.MTLSAliases.Token
+	}
+	return endpoints.Token
+}
+
+// certificateThumbprint is the base64url SHA-256 of the DER certificate, as
+// used in the x5t#S256 confirmation claim.
+func certificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// certHeader names the request header a TLS-terminating router puts the
+// client certificate in. Client certificates are public, so the header is
+// only believed from the routers in TrustedProxies, and those routers must
+// always strip or overwrite a copy sent by the client.
+type certHeader struct {
+	Name           string
+	TrustedProxies []*net.IPNet
+}
+
+// certHeaderFromEnv reads MTLS_CERT_HEADER and MTLS_TRUSTED_PROXIES, a comma
+// separated list of the routers' addresses or CIDR ranges, which is required
+// with the header.
+func certHeaderFromEnv(settings *Settings) (*certHeader, error) {
+	name := settings.Get("MTLS_CERT_HEADER")
+	if len(name) == 0 {
+		return nil, nil
+	}
+	ch := &certHeader{Name: name}
+	for _, entry := range splitList(settings.Get("MTLS_TRUSTED_PROXIES")) {
+		proxy := entry
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, invalidSetting(settings, "MTLS_TRUSTED_PROXIES", entry, "IP addresses or CIDR ranges")
+		}
+		ch.TrustedProxies = append(ch.TrustedProxies, cidr)
+	}
+	if len(ch.TrustedProxies) == 0 {
+		return nil, errors.New("MTLS_CERT_HEADER requires MTLS_TRUSTED_PROXIES, the addresses of the routers that set it.")
+	}
+	return ch, nil
+}
+
+// trusted reports whether r came directly from one of the trusted routers.
+// Requests that arrived over TLS were not terminated by a router.
+func (ch *certHeader) trusted(r *http.Request) bool {
+	if r.TLS != nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, cidr := range ch.TrustedProxies {
+		if ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestCertificate returns the client certificate of r, from the TLS
+// connection or, behind a trusted TLS-terminating router, from the header
+// (PEM, URL-encoded PEM, or base64 DER as Cloud Foundry sends it).
+func requestCertificate(r *http.Request, header *certHeader) (*x509.Certificate, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0], nil
+	}
+	if header == nil {
+		return nil, errNoClientCertificate
+	}
+	value := strings.TrimSpace(r.Header.Get(header.Name))
+	if len(value) == 0 {
+		return nil, errNoClientCertificate
+	}
+	if !header.trusted(r) {
+		return nil, fmt.Errorf("%s header from untrusted address %s", header.Name, r.RemoteAddr)
+	}
+	// PEM and base64 never contain %, so only URL-encoded values are unescaped;
+	// unescaping plain PEM would turn its + signs into spaces
+	if strings.Contains(value, "%") {
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+	}
+	var der []byte
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		if der, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("cannot decode %s header: %s", header.Name, err)
+		}
+	}
+	return x509.ParseCertificate(der)
+}
+
+// checkCertificateBinding enforces RFC 8705 section 3: a token carrying a
+// cnf.x5t#S256 claim is only accepted over a connection presenting that
+// certificate. Unbound tokens pass unchanged.
+func checkCertificateBinding(token *jwt.Token, r *http.Request, config *authConfig) error {
+	cnf, ok := token.Claims["cnf"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	thumbprint, ok := cnf["x5t#S256"].(string)
+	if !ok {
+		return nil
+	}
+	cert, err := requestCertificate(r, config.MTLSCertHeader)
+	if err != nil {
+		return &tokenValidationError{tokenBinding, "certificate-bound token: " + err.Error()}
+	}
+	if certificateThumbprint(cert) != strings.TrimRight(thumbprint, "=") {
+		return &tokenValidationError{tokenBinding, "token is bound to a different client certificate"}
+	}
+	return nil
+}
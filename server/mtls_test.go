@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// newTestCertificate returns a self-signed certificate for testSigningKey.
+func newTestCertificate(t *testing.T, name string) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &testSigningKey.PublicKey, testSigningKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeTestKeyPair writes a certificate for name and its key as PEM files.
+func writeTestKeyPair(t *testing.T, name string) (certFile string, keyFile string) {
+	cert := newTestCertificate(t, name)
+	certFile = writeTestFile(t, name+".crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	keyFile = writeTestFile(t, name+".key", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testSigningKey)})))
+	return certFile, keyFile
+}
+
+// trustsCertificate reports whether roots validates the certificate in certFile.
+func trustsCertificate(t *testing.T, roots *x509.CertPool, certFile string) bool {
+	b, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots})
+	return roots != nil && err == nil
+}
+
+func TestCheckCertificateBinding(t *testing.T) {
+	cert := newTestCertificate(t, "client")
+	other := newTestCertificate(t, "other")
+	pemCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+
+	header, err := certHeaderFromEnv(newTestSettings(map[string]string{
+		"MTLS_CERT_HEADER":     "X-Forwarded-Client-Cert",
+		"MTLS_TRUSTED_PROXIES": "10.0.0.1, 192.168.0.0/16",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig()
+	config.MTLSCertHeader = header
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        *tls.ConnectionState
+		header     string
+		unbound    bool
+		ok         bool
+	}{
+		{name: "unbound token", unbound: true, ok: true},
+		{name: "tls connection", tls: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, ok: true},
+		{name: "tls connection with another certificate", tls: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}}},
+		{name: "no certificate"},
+		{name: "pem header from trusted proxy", remoteAddr: "10.0.0.1:4000", header: pemCert, ok: true},
+		{name: "escaped pem header from trusted range", remoteAddr: "192.168.3.4:4000", header: url.QueryEscape(pemCert), ok: true},
+		{name: "der header from trusted proxy", remoteAddr: "10.0.0.1:4000", header: base64.StdEncoding.EncodeToString(cert.Raw), ok: true},
+		{name: "header from untrusted address", remoteAddr: "203.0.113.9:4000", header: pemCert},
+		{name: "header over a direct tls connection", remoteAddr: "10.0.0.1:4000", tls: &tls.ConnectionState{}, header: pemCert},
+		{name: "header with another certificate", remoteAddr: "10.0.0.1:4000", header: base64.StdEncoding.EncodeToString(other.Raw)},
+		{name: "garbage header", remoteAddr: "10.0.0.1:4000", header: "not a certificate"},
+	}
+	for _, tt := range tests {
+		claims := accessTokenClaims()
+		if !tt.unbound {
+			claims["cnf"] = map[string]interface{}{"x5t#S256": certificateThumbprint(cert)}
+		}
+		r := httptest.NewRequest("GET", "/api", nil)
+		r.TLS = tt.tls
+		if len(tt.remoteAddr) > 0 {
+			r.RemoteAddr = tt.remoteAddr
+		}
+		if len(tt.header) > 0 {
+			r.Header.Set("X-Forwarded-Client-Cert", tt.header)
+		}
+		err := checkCertificateBinding(&jwt.Token{Claims: claims}, r, config)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v", tt.name, err)
+		}
+	}
+}
+
+func TestCertHeaderFromEnv(t *testing.T) {
+	tests := []struct {
+		header  string
+		proxies string
+		err     string
+	}{
+		{"", "", ""},
+		{"X-Client-Cert", "10.0.0.1,fd00::1,10.2.0.0/16", ""},
+		{"X-Client-Cert", "", "requires MTLS_TRUSTED_PROXIES"},
+		{"X-Client-Cert", "router.example.com", "from test is invalid"},
+		{"X-Client-Cert", "10.0.0.0/33", "from test is invalid"},
+	}
+	for _, tt := range tests {
+		_, err := certHeaderFromEnv(newTestSettings(map[string]string{
+			"MTLS_CERT_HEADER":     tt.header,
+			"MTLS_TRUSTED_PROXIES": tt.proxies,
+		}))
+		if len(tt.err) == 0 && err != nil || len(tt.err) > 0 && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%q %q: error = %v, want %q", tt.header, tt.proxies, err, tt.err)
+		}
+	}
+}
@@ -1,120 +1,195 @@
 package server
 
 import (
-	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
+	"time"
 
 	"golang.org/x/oauth2"
 
 	"github.com/astaxie/beego/session"
-	"github.com/cloudfoundry-community/go-cfenv"
-	"github.com/cloudnativego/cf-tools"
 )
 
 type authConfig struct {
-	ClientID     string
-	ClientSecret string
-	Domain       string
-	CallbackURL  string
-	TokenKeyURL  string
-	tokenKey     string
-	Errors       []error
+	Name              string
+	DisplayName       string
+	ClientID          string
+	ClientSecret      string
+	Domain            string
+	CallbackURL       string
+	PKCEMethod        string
+	UserInfo          bool
+	staticEndpoints   *providerEndpoints
+	discovery         *providerDiscovery
+	keys              *keySet
+	Validation        *tokenValidation
+	RefreshMargin     time.Duration
+	Logout            *logoutConfig
+	Policy            *accessPolicy
+	validator         tokenValidator
+	ClientCredentials *clientCredentials
+	Exchange          *tokenExchange
+	Services          serviceRegistry
+	Gateway           *gatewayConfig
+	ForwardAuth       *forwardAuthConfig
+	Redirects         *redirectPolicy
+	HTTPClient        *http.Client
+	ClientAuthMethod  string
+	clientAuth        clientAuthenticator
+	MTLSCertHeader    *certHeader
+	Scopes            []string
+	// AllowedScopes are the scopes honored in this provider's tokens; nil
+	// honors all of them
+	AllowedScopes []string
+	Providers     *providerRegistry
+	SessionIndex  sessionIndex
+	Errors        []error
 }
 
-type keyObject struct {
-	// Alg is the encryption algorithm
-	Alg string `json:"alg"`
-	// Value is the actual pem-encoded key used to parse JWT tokens
-	Value string `json:"value"`
-	// Kty
-	Kty string `json:"kty,omitempty"`
-	// Use
-	Use string `json:"use,omitempty"`
-	// N
-	N string `json:"n,omitempty"`
-	// E
-	E string `json:"e,omitempty"`
-}
-
-func initOAuthConfig(appEnv *cfenv.App) (config *authConfig) {
+func initOAuthConfig(settings *Settings) (config *authConfig) {
 	config = &authConfig{}
 
-	authClientID, err := cftools.GetVCAPServiceProperty("sso", "client_id", appEnv)
+	authClientID := requiredSetting(settings, config, "SSO_CLIENT_ID", "the client_id of the sso service binding")
+	authSecret := settings.Get("SSO_CLIENT_SECRET")
+	authDomain := requiredSetting(settings, config, "SSO_AUTH_DOMAIN", "the auth_domain of the sso service binding")
+	authCallback := requiredSetting(settings, config, "AUTH_CALLBACK", "the callback url registered with the provider")
+
+	pkceMethod, err := pkceMethodFromEnv(settings)
 	config.appendError(err)
-	authSecret, err := cftools.GetVCAPServiceProperty("sso", "client_secret", appEnv)
+
+	fetchUserInfo, err := settings.Bool("FETCH_USERINFO", true)
 	config.appendError(err)
-	authDomain, err := cftools.GetVCAPServiceProperty("sso", "auth_domain", appEnv)
+
+	config.Name = defaultProviderName
+	config.DisplayName = settings.Get("SSO_DISPLAY_NAME")
+	config.Scopes = defaultScopes
+	config.ClientID = authClientID
+	config.ClientSecret = authSecret
+	config.Domain = authDomain
+	config.CallbackURL = authCallback
+	config.staticEndpoints = uaaEndpoints(authDomain, issuerFromEnv(settings, authDomain))
+	config.PKCEMethod = pkceMethod
+	config.UserInfo = fetchUserInfo
+
+	config.HTTPClient, err = httpClientFromEnv(settings)
+	if err != nil {
+		config.appendError(err)
+		config.HTTPClient = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	config.MTLSCertHeader, err = certHeaderFromEnv(settings)
 	config.appendError(err)
+	config.ClientAuthMethod, config.clientAuth, err = clientAuthFromEnv(settings, config)
+	if err != nil {
+		config.appendError(err)
+		config.clientAuth = &secretBasicAuth{authClientID, authSecret}
+	}
+	config.Validation, err = tokenValidationFromEnv(settings)
+	config.appendError(err)
+	config.RefreshMargin, err = refreshMarginFromEnv(settings)
+	config.appendError(err)
+	config.Redirects = redirectPolicyFromEnv(settings)
+	config.Logout, err = logoutConfigFromEnv(settings, authCallback)
+	config.appendError(err)
+	config.Policy, err = policyFromEnv(settings)
+	config.appendError(err)
+	config.validator, err = tokenValidatorFromEnv(settings, config)
+	config.appendError(err)
+	config.ClientCredentials = clientCredentialsFromEnv(settings)
+	config.Exchange, err = tokenExchangeFromEnv(settings)
+	config.appendError(err)
+	config.Services, err = servicesFromEnv(settings)
+	config.appendError(err)
+	config.Gateway, err = gatewayFromEnv(settings)
+	config.appendError(err)
+	config.ForwardAuth, err = forwardAuthFromEnv(settings)
+	config.appendError(err)
+	config.keys = newKeySet(func() string { return config.endpoints().JWKS }, config.HTTPClient)
 
-	authCallback := os.Getenv("AUTH_CALLBACK")
-	if len(authCallback) == 0 {
-		err = errors.New("Could not retrieve callback url from environment.")
+	// Load the provider metadata document when discovery is enabled
+	config.discovery, err = discoveryFromEnv(settings, authDomain, settings.Get("OIDC_ISSUER"), config.HTTPClient)
+	config.appendError(err)
+	if config.discovery != nil {
+		_, err = config.discovery.get()
 		config.appendError(err)
 	}
 
-	tokenKeyURL := fmt.Sprintf("%s/token_key", authDomain)
+	// Register the additional identity providers and load their metadata
+	if _, err = providersFromEnv(settings, config); err != nil {
+		config.appendError(err)
+		config.Providers = &providerRegistry{list: []*authConfig{config}, byName: map[string]*authConfig{config.Name: config}}
+	}
+	for _, p := range config.Providers.list[1:] {
+		if p.discovery != nil {
+			if _, err = p.discovery.get(); err != nil {
+				config.appendError(fmt.Errorf("Identity provider %s: %s", p.Name, err))
+			}
+		}
+	}
 
-	config.ClientID = authClientID
-	config.ClientSecret = authSecret
-	config.Domain = authDomain
-	config.CallbackURL = authCallback
-	config.TokenKeyURL = tokenKeyURL
+	if config.Logout != nil {
+		if _, ok := config.safeRedirectURL(config.Logout.LandingURL); !ok {
+			config.appendError(fmt.Errorf("LOGOUT_LANDING_URL %q is not an allowed redirect; add its host to REDIRECT_ALLOWED_HOSTS", config.Logout.LandingURL))
+		}
+	}
 
 	return
 }
 
+var defaultScopes = []string{"openid", "test.access", "test.admin"}
+
+// oauthConfig returns the oauth2 client configuration for the authorization code flow.
+func (ac *authConfig) oauthConfig() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     ac.ClientID,
+		ClientSecret: ac.ClientSecret,
+		RedirectURL:  ac.CallbackURL,
+		Scopes:       ac.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  ac.endpoints().Authorization,
+			TokenURL: ac.tokenURL(),
+		},
+	}
+}
+
+// authCodeURL returns the authorize redirect for a login attempt, including
+// the OpenID Connect nonce and the PKCE code challenge when enabled.
+func (ac *authConfig) authCodeURL(la *loginAttempt) string {
+	opts := []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("nonce", la.Nonce)}
+	if len(la.Verifier) > 0 {
+		opts = append(opts,
+			oauth2.SetAuthURLParam("code_challenge", codeChallenge(la.Verifier, ac.PKCEMethod)),
+			oauth2.SetAuthURLParam("code_challenge_method", ac.PKCEMethod))
+	}
+	return ac.oauthConfig().AuthCodeURL(la.State, opts...)
+}
+
 func (ac *authConfig) appendError(err error) {
 	if err != nil {
 		ac.Errors = append(ac.Errors, err)
 	}
 }
 
-func (ac *authConfig) hasErrors() bool {
-	if len(ac.Errors) > 0 {
-		return true
+// requiredSetting returns the named setting, recording an error when no
+// configuration source sets it.
+func requiredSetting(settings *Settings, config *authConfig, key string, description string) string {
+	v := settings.Get(key)
+	if len(v) == 0 {
+		config.appendError(fmt.Errorf("%s is not set; provide %s", key, description))
 	}
-	return false
+	return v
 }
 
-func (ac *authConfig) getTokenKey() (key string, err error) {
-	if len(ac.tokenKey) == 0 {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		client := &http.Client{Transport: tr}
-		resp, err := client.Get(ac.TokenKeyURL)
-		defer resp.Body.Close()
-		if err != nil {
-			return "", err
-		}
-
-		payload, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println("ERROR RETRIEVING TOKEN_KEY!")
-			return "", err
-		}
-
-		ko := &keyObject{}
-		err = json.Unmarshal(payload, ko)
-		if err != nil {
-			fmt.Println("ERROR PARSING TOKEN_KEY!")
-			return "", err
-		}
+// invalidSetting describes a setting whose value could not be used.
+func invalidSetting(settings *Settings, key string, value string, want string) error {
+	return fmt.Errorf("%s %q from %s is invalid; expected %s", key, value, settings.Source(key), want)
+}
 
-		fmt.Printf("RETRIEVED KEY: %s\n", ko.Value)
-		if len(ko.Value) == 0 {
-			fmt.Println("RETRIEVED TOKEN KEY IS EMPTY!")
-			return "", err
-		}
-		ac.tokenKey = ko.Value
+func (ac *authConfig) hasErrors() bool {
+	if len(ac.Errors) > 0 {
+		return true
 	}
-
-	return ac.tokenKey, nil
+	return false
 }
 
 func tokenToJSON(token *oauth2.Token) (string, error) {
@@ -133,16 +208,20 @@ func tokenFromJSON(jsonStr string) (*oauth2.Token, error) {
 	return &token, nil
 }
 
-func tokenFromSession(sm *session.Manager, w http.ResponseWriter, r *http.Request) (token *oauth2.Token, err error) {
-	session, _ := sm.SessionStart(w, r)
-	defer session.SessionRelease(w)
+// tokenFromSession returns the session's token and the provider that issued it.
+func tokenFromSession(sm *session.Manager, w http.ResponseWriter, r *http.Request, config *authConfig) (token *oauth2.Token, provider *authConfig, err error) {
+	session, _ := startSession(sm, w, r)
+	defer releaseSession(w, session)
 
-	jsonToken := session.Get("token")
-	token, err = tokenFromJSON(jsonToken.(string))
+	jsonToken, ok := session.Get("token").(string)
+	if !ok {
+		return nil, nil, errNoSessionToken
+	}
+	token, err = tokenFromJSON(jsonToken)
 	if err != nil {
 		fmt.Printf("Error retrieving token from session: %s\n", err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	return token, nil
+	return token, config.forSession(session), nil
 }
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// PKCE (RFC 7636) code challenge methods. pkceOff disables PKCE entirely.
+const (
+	pkceS256  = "S256"
+	pkcePlain = "plain"
+	pkceOff   = "off"
+)
+
+// pkceMethodFromEnv reads PKCE_METHOD, defaulting to S256.
+func pkceMethodFromEnv(settings *Settings) (string, error) {
+	method := settings.Get("PKCE_METHOD")
+	switch strings.ToLower(method) {
+	case "", "s256":
+		return pkceS256, nil
+	case "plain":
+		return pkcePlain, nil
+	case "off", "none", "false":
+		return pkceOff, nil
+	}
+	return "", invalidSetting(settings, "PKCE_METHOD", method, "S256, plain or off")
+}
+
+// newCodeVerifier returns a 43 character verifier, the minimum length allowed by the RFC.
+func newCodeVerifier() (string, error) {
+	return randomString(32)
+}
+
+// codeChallenge derives the code_challenge sent on the authorize redirect.
+func codeChallenge(verifier, method string) string {
+	if method == pkcePlain {
+		return verifier
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"regexp"
+	"testing"
+)
+
+// unreservedPattern matches a verifier of RFC 7636 unreserved characters.
+var unreservedPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+func TestNewCodeVerifier(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		verifier, err := newCodeVerifier()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !unreservedPattern.MatchString(verifier) {
+			t.Fatalf("verifier %q is not 43-128 unreserved characters", verifier)
+		}
+		if seen[verifier] {
+			t.Fatalf("verifier %q repeated", verifier)
+		}
+		seen[verifier] = true
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	tests := []struct {
+		name     string
+		verifier string
+		method   string
+		want     string
+	}{
+		// RFC 7636 appendix B
+		{"S256 test vector", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", pkceS256, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		{"plain", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", pkcePlain, "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"},
+	}
+	for _, tt := range tests {
+		if got := codeChallenge(tt.verifier, tt.method); got != tt.want {
+			t.Errorf("%s: challenge = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPKCEMethodFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"", pkceS256, true},
+		{"s256", pkceS256, true},
+		{"plain", pkcePlain, true},
+		{"off", pkceOff, true},
+		{"S512", "", false},
+	}
+	for _, tt := range tests {
+		got, err := pkceMethodFromEnv(newTestSettings(map[string]string{"PKCE_METHOD": tt.value}))
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%q: got %q, %v", tt.value, got, err)
+		}
+	}
+}
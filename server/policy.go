@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/astaxie/beego/session"
+	"github.com/codegangsta/negroni"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	matchAny = "any"
+	matchAll = "all"
+)
+
+// policyRule grants access to requests matching Path and Methods when the
+// access token carries any (or all) of Scopes. Path is a path.Match pattern;
+// a trailing "/**" matches everything below the prefix.
+type policyRule struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"`
+	Match   string   `json:"match,omitempty"`
+}
+
+// accessPolicy is the ordered rule table consulted for protected routes. The
+// first matching rule decides; requests matching no rule are allowed only
+// when Default is "allow".
+type accessPolicy struct {
+	Default string       `json:"default"`
+	Rules   []policyRule `json:"rules"`
+}
+
+// defaultPolicy protects the sample's own pages and JSON API.
+var defaultPolicy = &accessPolicy{
+	Default: "deny",
+	Rules: []policyRule{
+		{Path: "/protected/user"},
+		{Path: "/protected/backing"},
+		{Path: "/protected/services/**"},
+		{Path: "/protected/access", Scopes: []string{"test.access", "test.admin"}, Match: matchAny},
+		{Path: "/protected/admin/**", Scopes: []string{"test.admin"}, Match: matchAll},
+		{Path: "/api/**"},
+	},
+}
+
+// policyFromEnv loads the JSON policy named by ACCESS_POLICY_FILE, or returns
+// the default policy.
+func policyFromEnv(settings *Settings) (*accessPolicy, error) {
+	file := settings.Get("ACCESS_POLICY_FILE")
+	if len(file) == 0 {
+		return defaultPolicy, nil
+	}
+	return policyFromFile(file)
+}
+
+// policyFromFile loads and validates a JSON access policy.
+func policyFromFile(file string) (*accessPolicy, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read access policy: %s", err)
+	}
+	policy := &accessPolicy{}
+	if err := json.Unmarshal(raw, policy); err != nil {
+		return nil, fmt.Errorf("Could not parse access policy %s: %s", file, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid access policy %s: %s", file, err)
+	}
+	return policy, nil
+}
+
+func (p *accessPolicy) validate() error {
+	switch p.Default {
+	case "":
+		p.Default = "deny"
+	case "allow", "deny":
+	default:
+		return fmt.Errorf("default must be allow or deny, not %q", p.Default)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if _, err := path.Match(strings.TrimSuffix(rule.Path, "/**"), "/"); err != nil {
+			return fmt.Errorf("bad path pattern %q", rule.Path)
+		}
+		switch rule.Match {
+		case "":
+			rule.Match = matchAny
+		case matchAny, matchAll:
+		default:
+			return fmt.Errorf("match must be any or all, not %q", rule.Match)
+		}
+		for j, m := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(m)
+		}
+	}
+	return nil
+}
+
+// rule returns the first rule matching the request, or nil.
+func (p *accessPolicy) rule(method string, urlPath string) *policyRule {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if len(rule.Methods) > 0 && !containsString(rule.Methods, method) {
+			continue
+		}
+		if rule.matchesPath(urlPath) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (rule *policyRule) matchesPath(urlPath string) bool {
+	if strings.HasSuffix(rule.Path, "/**") {
+		prefix := strings.TrimSuffix(rule.Path, "/**")
+		return urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+	}
+	ok, _ := path.Match(rule.Path, urlPath)
+	return ok
+}
+
+// allows reports whether the token satisfies the rule's scopes.
+func (rule *policyRule) allows(token *jwt.Token) bool {
+	if len(rule.Scopes) == 0 {
+		return true
+	}
+	if rule.Match == matchAll {
+		return hasAllScopes(token, rule.Scopes...)
+	}
+	return hasScope(token, rule.Scopes...)
+}
+
+// authorize enforces the access policy on the session's access token.
+func authorize(sessionManager *session.Manager, config *authConfig) negroni.HandlerFunc {
+	return authorizePolicy(sessionManager, config, config.Policy)
+}
+
+// authorizePolicy enforces policy on the session's access token.
+func authorizePolicy(sessionManager *session.Manager, config *authConfig, policy *accessPolicy) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		token, provider, err := tokenFromSession(sessionManager, w, r, config)
+		if err != nil {
+			config.redirect(w, r, "/unauthorized")
+			return
+		}
+		accessToken, err := parseToken(token.AccessToken, provider)
+		if err != nil {
+			rejectToken(w, r, config, err)
+			return
+		}
+
+		rule := policy.rule(r.Method, r.URL.Path)
+		allowed := policy.Default == "allow"
+		if rule != nil {
+			allowed = rule.allows(accessToken)
+		}
+		if !allowed {
+			fmt.Printf("Access policy denied %s %s\n", r.Method, r.URL.Path)
+			config.redirect(w, r, "/unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
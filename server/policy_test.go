@@ -0,0 +1,173 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/astaxie/beego/session"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		scopes []string
+		allow  bool
+	}{
+		{"GET", "/protected/user", nil, true},
+		{"GET", "/protected/access", []string{"test.access"}, true},
+		{"GET", "/protected/access", []string{"test.admin"}, true},
+		{"GET", "/protected/access", []string{"test.read"}, false},
+		{"GET", "/protected/admin", []string{"test.admin"}, true},
+		{"POST", "/protected/admin/revoke", []string{"test.admin"}, true},
+		{"POST", "/protected/admin/revoke", []string{"test.access"}, false},
+		{"GET", "/protected/adminx", []string{"test.access"}, false},
+		{"GET", "/protected/unlisted", []string{"test.admin"}, false},
+		{"GET", "/protected/user/extra", nil, false},
+	}
+	for _, tt := range tests {
+		token := &jwt.Token{Claims: accessTokenClaims(tt.scopes...)}
+		rule := defaultPolicy.rule(tt.method, tt.path)
+		allowed := defaultPolicy.Default == "allow"
+		if rule != nil {
+			allowed = rule.allows(token)
+		}
+		if allowed != tt.allow {
+			t.Errorf("%s %s with %v: allowed = %v", tt.method, tt.path, tt.scopes, allowed)
+		}
+	}
+}
+
+func TestPolicyRuleMatching(t *testing.T) {
+	policy := &accessPolicy{Rules: []policyRule{
+		{Path: "/reports/*", Methods: []string{"get"}, Scopes: []string{"reports.read"}},
+		{Path: "/reports/*", Scopes: []string{"reports.write"}},
+		{Path: "/api/**", Scopes: []string{"api.read", "api.write"}, Match: matchAll},
+	}}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method string
+		path   string
+		scopes []string
+		allow  bool
+	}{
+		{"GET", "/reports/q1", []string{"reports.read"}, true},
+		{"POST", "/reports/q1", []string{"reports.read"}, false},
+		{"POST", "/reports/q1", []string{"reports.write"}, true},
+		{"GET", "/reports/q1/raw", []string{"reports.read"}, false},
+		{"GET", "/api", []string{"api.read", "api.write"}, true},
+		{"GET", "/api/v1/items", []string{"api.read"}, false},
+		{"GET", "/apiary", []string{"api.read", "api.write"}, false},
+	}
+	for _, tt := range tests {
+		token := &jwt.Token{Claims: accessTokenClaims(tt.scopes...)}
+		rule := policy.rule(tt.method, tt.path)
+		allowed := rule != nil && rule.allows(token)
+		if allowed != tt.allow {
+			t.Errorf("%s %s with %v: allowed = %v", tt.method, tt.path, tt.scopes, allowed)
+		}
+	}
+}
+
+func TestPolicyFromFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{"valid", `{"default":"allow","rules":[{"path":"/a/**","scopes":["x"],"match":"all"}]}`, ""},
+		{"default deny", `{"rules":[]}`, ""},
+		{"bad default", `{"default":"maybe"}`, "default must be"},
+		{"bad match", `{"rules":[{"path":"/a","match":"some"}]}`, "match must be"},
+		{"bad pattern", `{"rules":[{"path":"/a/["}]}`, "bad path pattern"},
+		{"not json", `default: deny`, "Could not parse"},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(dir, "policy.json")
+		ioutil.WriteFile(file, []byte(tt.policy), 0600)
+		policy, err := policyFromFile(file)
+		if len(tt.err) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			} else if policy.Default != "allow" && policy.Default != "deny" {
+				t.Errorf("%s: default = %q", tt.name, policy.Default)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	if _, err := policyFromFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing policy file was accepted")
+	}
+}
+
+// newTestSessionManager returns an in-memory session manager.
+func newTestSessionManager(t *testing.T) *session.Manager {
+	sm, err := session.NewManager("memory", `{"cookieName":"gosessionid","gclifetime":3600}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sm
+}
+
+// loggedInRequest stores token in a new session and returns a request carrying its cookie.
+func loggedInRequest(t *testing.T, sm *session.Manager, method string, target string, token *oauth2.Token) *http.Request {
+	w := httptest.NewRecorder()
+	sess, err := sm.SessionStart(w, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonToken, _ := tokenToJSON(token)
+	sess.Set("token", jsonToken)
+	sess.Set("profile", map[string]interface{}{"sub": "user-1"})
+	sess.SessionRelease(w)
+
+	r := httptest.NewRequest(method, target, nil)
+	r.AddCookie(sessionCookie(t, w))
+	return r
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"allowed", "/protected/admin", "admin", http.StatusOK},
+		{"missing scope", "/protected/admin", "access", http.StatusFound},
+		{"unlisted path", "/protected/other", "admin", http.StatusFound},
+		{"forged token", "/protected/admin", "forged", http.StatusFound},
+	}
+	config := newTestConfig()
+	config.Providers = &providerRegistry{list: []*authConfig{config}, byName: map[string]*authConfig{config.Name: config}}
+	sm := newTestSessionManager(t)
+	tokens := map[string]string{
+		"admin":  signTestToken(t, accessTokenClaims("test.admin"), nil, nil),
+		"access": signTestToken(t, accessTokenClaims("test.access"), nil, nil),
+		"forged": tamper(signTestToken(t, accessTokenClaims("test.access"), nil, nil)),
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		r := loggedInRequest(t, sm, "GET", tt.path, &oauth2.Token{AccessToken: tokens[tt.token]})
+		w := httptest.NewRecorder()
+		authorize(sm, config)(w, r, next)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if w.Code == http.StatusFound && w.Header().Get("Location") != "/unauthorized" {
+			t.Errorf("%s: redirected to %s", tt.name, w.Header().Get("Location"))
+		}
+	}
+}
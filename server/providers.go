@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/astaxie/beego/session"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultProviderName = "sso"
+	providerTag         = "oidc"
+)
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// providerSettings describes an additional identity provider, read from a
+// service tagged "oidc" or from IDENTITY_PROVIDERS_FILE.
+type providerSettings struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	ClientID    string `json:"client_id"`
+	// ClientSecret is empty for providers using certificate authentication
+	ClientSecret string `json:"client_secret"`
+	// AuthDomain is a UAA server; Issuer an OpenID provider found by discovery
+	AuthDomain   string `json:"auth_domain"`
+	Issuer       string `json:"issuer"`
+	DiscoveryURL string `json:"discovery_url"`
+	// CallbackURL defaults to AUTH_CALLBACK followed by /<name>
+	CallbackURL string   `json:"callback_url"`
+	Scopes      []string `json:"scopes"`
+	// ClientAuthMethod is client_secret_basic, client_secret_post or client_secret_jwt
+	ClientAuthMethod string `json:"client_auth_method"`
+	// AllowedScopes are the scopes the app honors in the provider's tokens.
+	// None are by default, so a partner cannot grant the app's privileged scopes.
+	AllowedScopes []string `json:"allowed_scopes"`
+}
+
+// providerRegistry holds the identity providers users can log in with. Each
+// provider is an authConfig sharing the app-wide settings of the first.
+type providerRegistry struct {
+	list   []*authConfig
+	byName map[string]*authConfig
+}
+
+func (pr *providerRegistry) add(p *authConfig) error {
+	if _, ok := pr.byName[p.Name]; ok {
+		return fmt.Errorf("Identity provider %q is configured twice", p.Name)
+	}
+	pr.list = append(pr.list, p)
+	pr.byName[p.Name] = p
+	return nil
+}
+
+func (pr *providerRegistry) get(name string) (*authConfig, bool) {
+	p, ok := pr.byName[name]
+	return p, ok
+}
+
+// forSession returns the provider that issued the session's tokens, or ac for
+// sessions that do not name one. Tokens must be parsed with the provider
+// returned, which limits their scopes to the provider's AllowedScopes.
+func (ac *authConfig) forSession(sess session.Store) *authConfig {
+	if name, ok := sess.Get("provider").(string); ok {
+		if p, ok := ac.Providers.get(name); ok {
+			return p
+		}
+	}
+	return ac
+}
+
+// upstreamProfile returns the profile of a user of provider p as passed to
+// upstreams. For providers other than the default one the sub, user_name and
+// email claims are prefixed with the provider name, so a partner IdP cannot
+// pass its user off as a corporate user with the same user_name or email.
+func (ac *authConfig) upstreamProfile(p *authConfig, profile map[string]interface{}) map[string]interface{} {
+	if p.Name == ac.Providers.list[0].Name {
+		return profile
+	}
+	namespaced := make(map[string]interface{}, len(profile))
+	for claim, v := range profile {
+		namespaced[claim] = v
+	}
+	for _, claim := range userIdentityClaims {
+		if v, ok := profile[claim].(string); ok && len(v) > 0 {
+			namespaced[claim] = p.Name + ":" + v
+		}
+	}
+	return namespaced
+}
+
+// forBearer picks the provider whose issuer matches the iss claim of a JWT
+// bearer token. Opaque tokens and unknown issuers go to ac. The claim is not
+// verified yet; parsing with the returned provider checks the signature with
+// its keys and limits the scopes to its AllowedScopes.
+func (ac *authConfig) forBearer(raw string) *authConfig {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 || len(ac.Providers.list) < 2 {
+		return ac
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ac
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return ac
+	}
+	for _, p := range ac.Providers.list {
+		if p.endpoints().Issuer == claims.Issuer {
+			return p
+		}
+	}
+	return ac
+}
+
+// providersFromEnv registers config itself and the providers bound as
+// services tagged "oidc" or listed in the JSON array in IDENTITY_PROVIDERS_FILE.
+func providersFromEnv(settings *Settings, config *authConfig) (*providerRegistry, error) {
+	pr := &providerRegistry{byName: make(map[string]*authConfig)}
+	config.Providers = pr
+	if err := pr.add(config); err != nil {
+		return nil, err
+	}
+
+	var providers []*providerSettings
+	if appEnv := settings.appEnv; appEnv != nil {
+		if services, err := appEnv.Services.WithTag(providerTag); err == nil {
+			for _, s := range services {
+				raw, _ := json.Marshal(s.Credentials)
+				ps := &providerSettings{}
+				if err := json.Unmarshal(raw, ps); err != nil {
+					return nil, fmt.Errorf("Invalid credentials on identity provider service %s: %s", s.Name, err)
+				}
+				if len(ps.Name) == 0 {
+					ps.Name = strings.ToLower(s.Name)
+				}
+				providers = append(providers, ps)
+			}
+		}
+	}
+	if file := settings.Get("IDENTITY_PROVIDERS_FILE"); len(file) > 0 {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read identity providers: %s", err)
+		}
+		var fromFile []*providerSettings
+		if err := json.Unmarshal(raw, &fromFile); err != nil {
+			return nil, fmt.Errorf("Could not parse identity providers %s: %s", file, err)
+		}
+		providers = append(providers, fromFile...)
+	}
+
+	for _, ps := range providers {
+		p, err := newProvider(config, ps)
+		if err != nil {
+			return nil, err
+		}
+		if err := pr.add(p); err != nil {
+			return nil, err
+		}
+	}
+	return pr, nil
+}
+
+// newProvider derives a provider from the primary config, replacing the
+// client registration, endpoints, keys and token caches.
+func newProvider(base *authConfig, ps *providerSettings) (*authConfig, error) {
+	if !providerNamePattern.MatchString(ps.Name) {
+		return nil, fmt.Errorf("Identity provider name %q must be lower case letters, digits, - or _", ps.Name)
+	}
+	if len(ps.ClientID) == 0 {
+		return nil, fmt.Errorf("Identity provider %s has no client_id", ps.Name)
+	}
+	domain := strings.TrimSuffix(ps.AuthDomain, "/")
+	if len(domain) == 0 {
+		domain = strings.TrimSuffix(ps.Issuer, "/")
+	}
+	if len(domain) == 0 {
+		return nil, fmt.Errorf("Identity provider %s needs an auth_domain or an issuer", ps.Name)
+	}
+
+	p := new(authConfig)
+	*p = *base
+	p.Errors = nil
+	p.Name = ps.Name
+	p.DisplayName = ps.DisplayName
+	if len(p.DisplayName) == 0 {
+		p.DisplayName = ps.Name
+	}
+	p.ClientID = ps.ClientID
+	p.ClientSecret = ps.ClientSecret
+	p.Domain = domain
+	p.CallbackURL = ps.CallbackURL
+	if len(p.CallbackURL) == 0 {
+		p.CallbackURL = strings.TrimSuffix(base.CallbackURL, "/") + "/" + ps.Name
+	}
+	if len(ps.Scopes) > 0 {
+		p.Scopes = ps.Scopes
+	}
+	p.AllowedScopes = append([]string{}, ps.AllowedScopes...)
+
+	issuer := ps.Issuer
+	if len(issuer) == 0 {
+		issuer = domain + "/oauth/token"
+	}
+	p.staticEndpoints = uaaEndpoints(domain, issuer)
+	p.discovery = nil
+	if len(ps.Issuer) > 0 || len(ps.DiscoveryURL) > 0 {
+		discoveryURL := ps.DiscoveryURL
+		if len(discoveryURL) == 0 {
+			discoveryURL = domain + wellKnownPath
+		}
+		p.discovery = &providerDiscovery{URL: discoveryURL, Issuer: ps.Issuer, Refresh: defaultDiscoveryRefresh, client: base.HTTPClient}
+	}
+	p.keys = newKeySet(func() string { return p.endpoints().JWKS }, base.HTTPClient)
+	p.validator = &localJWTValidator{config: p}
+
+	switch ps.ClientAuthMethod {
+	case "", clientSecretBasic:
+		p.ClientAuthMethod, p.clientAuth = clientSecretBasic, &secretBasicAuth{p.ClientID, p.ClientSecret}
+	case clientSecretPost:
+		p.ClientAuthMethod, p.clientAuth = clientSecretPost, &secretPostAuth{p.ClientID, p.ClientSecret}
+	case clientSecretJWT:
+		if len(p.ClientSecret) == 0 {
+			return nil, fmt.Errorf("Identity provider %s uses client_secret_jwt but has no client_secret", ps.Name)
+		}
+		p.ClientAuthMethod, p.clientAuth = clientSecretJWT, &assertionAuth{clientID: p.ClientID, method: jwt.SigningMethodHS256, key: []byte(p.ClientSecret)}
+	default:
+		return nil, fmt.Errorf("Identity provider %s has unsupported client_auth_method %q", ps.Name, ps.ClientAuthMethod)
+	}
+
+	// Tokens from one provider must never be served for another
+	p.ClientCredentials = &clientCredentials{Scopes: base.ClientCredentials.Scopes, sources: make(map[string]*clientCredentialsSource)}
+	p.Exchange = &tokenExchange{
+		Enabled:  base.Exchange.Enabled,
+		Audience: base.Exchange.Audience,
+		Scopes:   base.Exchange.Scopes,
+		Fallback: base.Exchange.Fallback,
+		cache:    make(map[string]*oauth2.Token),
+	}
+	return p, nil
+}
+
+// chooserPage lists the identity providers. Each link starts a login that
+// returns to returnTo.
+func chooserPage(w http.ResponseWriter, config *authConfig, returnTo string) {
+	var links string
+	for _, p := range config.Providers.list {
+		q := url.Values{"provider": {p.Name}}
+		if len(returnTo) > 0 {
+			q.Set("rd", returnTo)
+		}
+		links += fmt.Sprintf("\n      <li><a href=\"/login?%s\">%s</a></li>", html.EscapeString(q.Encode()), html.EscapeString(p.DisplayName))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `
+<html>
+  <head>
+    <title>OAuth Authcode Sample</title>
+  </head>
+  <body>
+    <h2>Welcome to the OAuth Authcode Home Page</h2>
+    <p>We don't know who you are.  Please log in with one of these accounts:</p>
+    <ul>%s
+    </ul>
+  </body>
+</html>
+`, links)
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/session"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+const partnerIssuer = "https://partner.example.org/oauth/token"
+
+// partnerSigningKey is the key of the partner provider in newTestProviders.
+var partnerSigningKey = func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// newTestProviders returns the test config with a partner provider named
+// "partner" registered after it, allowed to grant allowedScopes.
+func newTestProviders(t *testing.T, allowedScopes ...string) (*authConfig, *authConfig) {
+	config := newTestConfig()
+	config.ClientCredentials = &clientCredentials{sources: make(map[string]*clientCredentialsSource)}
+	config.Exchange = &tokenExchange{cache: make(map[string]*oauth2.Token)}
+	config.Providers = &providerRegistry{byName: make(map[string]*authConfig)}
+	config.Providers.add(config)
+	partner, err := newProvider(config, &providerSettings{
+		Name:          "partner",
+		ClientID:      "partner-client",
+		AuthDomain:    "https://partner.example.org",
+		AllowedScopes: allowedScopes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partner.keys = &keySet{
+		url:       func() string { return "" },
+		keys:      map[string]interface{}{testKeyID: &partnerSigningKey.PublicKey},
+		expires:   time.Now().Add(time.Hour),
+		lastFetch: time.Now(),
+	}
+	if err := config.Providers.add(partner); err != nil {
+		t.Fatal(err)
+	}
+	return config, partner
+}
+
+// partnerToken returns an access token issued by the partner provider.
+func partnerToken(t *testing.T, scopes ...string) string {
+	claims := accessTokenClaims(scopes...)
+	claims["iss"] = partnerIssuer
+	return signTestToken(t, claims, jwt.SigningMethodRS256, partnerSigningKey)
+}
+
+func TestProviderAllowedScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		partner bool
+		want    []string
+	}{
+		{"primary provider keeps all scopes", nil, false, []string{"test.admin", "test.access"}},
+		{"partner grants no scopes by default", nil, true, nil},
+		{"partner grants only allowed scopes", []string{"test.access"}, true, []string{"test.access"}},
+	}
+	for _, tt := range tests {
+		config, partner := newTestProviders(t, tt.allowed...)
+		raw := signTestToken(t, accessTokenClaims("test.admin", "test.access"), nil, nil)
+		provider := config
+		if tt.partner {
+			raw = partnerToken(t, "test.admin", "test.access")
+			provider = partner
+		}
+		token, err := parseToken(raw, provider)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := claimStrings(token.Claims["scope"]); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: scopes = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForBearer(t *testing.T) {
+	config, partner := newTestProviders(t)
+	unknown := accessTokenClaims()
+	unknown["iss"] = "https://unknown.example.com"
+	tests := []struct {
+		name  string
+		token string
+		want  *authConfig
+	}{
+		{"primary issuer", signTestToken(t, accessTokenClaims(), nil, nil), config},
+		{"partner issuer", partnerToken(t), partner},
+		{"unknown issuer", signTestToken(t, unknown, nil, nil), config},
+		{"opaque token", "opaque-token", config},
+		{"undecodable payload", "a.!!!.c", config},
+	}
+	for _, tt := range tests {
+		if got := config.forBearer(tt.token); got != tt.want {
+			t.Errorf("%s: chose %s, want %s", tt.name, got.Name, tt.want.Name)
+		}
+	}
+}
+
+func TestRequireBearerWithPartnerTokens(t *testing.T) {
+	config, _ := newTestProviders(t, "test.access")
+	// A token claiming the partner's issuer is checked with the partner's keys
+	forged := accessTokenClaims("test.admin")
+	forged["iss"] = partnerIssuer
+	// and one claiming the primary issuer with the primary's
+	stolen := accessTokenClaims("test.admin")
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"partner token with an allowed scope", "/protected/access", partnerToken(t, "test.access"), http.StatusOK},
+		{"partner token with an admin scope", "/protected/admin", partnerToken(t, "test.admin"), http.StatusForbidden},
+		{"partner issuer signed with another key", "/protected/admin", signTestToken(t, forged, nil, nil), http.StatusUnauthorized},
+		{"primary issuer signed by the partner", "/protected/admin", signTestToken(t, stolen, jwt.SigningMethodRS256, partnerSigningKey), http.StatusUnauthorized},
+		{"primary token with an admin scope", "/protected/admin", signTestToken(t, accessTokenClaims("test.admin"), nil, nil), http.StatusOK},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		requireBearer(config)(w, r, next)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
+
+func TestForSession(t *testing.T) {
+	config, partner := newTestProviders(t)
+	tests := []struct {
+		provider interface{}
+		want     *authConfig
+	}{
+		{nil, config},
+		{"partner", partner},
+		{"removed", config},
+		{defaultProviderName, config},
+	}
+	for _, tt := range tests {
+		sess := newTestSession(t)
+		if tt.provider != nil {
+			sess.Set("provider", tt.provider)
+		}
+		if got := config.forSession(sess); got != tt.want {
+			t.Errorf("%v: chose %s, want %s", tt.provider, got.Name, tt.want.Name)
+		}
+	}
+}
+
+func TestCallbackProviderMixUp(t *testing.T) {
+	config, _ := newTestProviders(t)
+	sm := newTestSessionManager(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/callback", callbackHandler(sm, config))
+	router.HandleFunc("/callback/{provider}", callbackHandler(sm, config))
+
+	tests := []struct {
+		name     string
+		started  string
+		callback string
+		status   int
+	}{
+		{"primary login answered by the partner", defaultProviderName, "/callback/partner", http.StatusBadRequest},
+		{"partner login answered on the primary callback", "partner", "/callback", http.StatusBadRequest},
+		{"primary provider by name", defaultProviderName, "/callback/" + defaultProviderName, http.StatusNotFound},
+		{"unknown provider", "partner", "/callback/unknown", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		sess, err := sm.SessionStart(w, httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		saveLoginAttempt(sess, &loginAttempt{State: "state-1", Nonce: "nonce-1", Provider: tt.started, Created: time.Now()})
+		sess.SessionRelease(w)
+
+		r := httptest.NewRequest("GET", tt.callback+"?state=state-1&code=code-1", nil)
+		r.AddCookie(sessionCookie(t, w))
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
+
+// providerRequest returns a request whose session holds token and profile from provider.
+func providerRequest(t *testing.T, sm *session.Manager, target string, provider string, token string, profile map[string]interface{}) *http.Request {
+	w := httptest.NewRecorder()
+	sess, err := sm.SessionStart(w, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonToken, _ := tokenToJSON(&oauth2.Token{AccessToken: token})
+	sess.Set("token", jsonToken)
+	sess.Set("profile", profile)
+	sess.Set("provider", provider)
+	sess.SessionRelease(w)
+
+	r := httptest.NewRequest("GET", target, nil)
+	r.AddCookie(sessionCookie(t, w))
+	return r
+}
+
+func TestUpstreamIdentityNamesProvider(t *testing.T) {
+	var upstreamHeaders http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders = r.Header
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	config, _ := newTestProviders(t)
+	secret := []byte(strings.Repeat("s", 32))
+	config.Gateway = &gatewayConfig{Upstream: upstreamURL, Headers: true, JWTHeader: defaultGatewayJWTHeader, JWTSecret: secret, JWTTTL: time.Minute, Transport: http.DefaultTransport}
+	config.ForwardAuth = &forwardAuthConfig{Policy: &accessPolicy{Default: "allow"}}
+	sm := newTestSessionManager(t)
+	profile := map[string]interface{}{"sub": "u-1", "user_name": "alice", "email": "alice@example.com", "name": "Alice"}
+
+	tests := []struct {
+		provider string
+		token    string
+		user     string
+		email    string
+		issuer   string
+	}{
+		{defaultProviderName, signTestToken(t, accessTokenClaims(), nil, nil), "alice", "alice@example.com", testIssuer},
+		{"partner", partnerToken(t), "partner:alice", "partner:alice@example.com", partnerIssuer},
+	}
+	for _, tt := range tests {
+		// Forward auth answers with the identity headers
+		r := providerRequest(t, sm, "/auth/verify", tt.provider, tt.token, profile)
+		r.Header.Set("X-Original-URI", "/reports")
+		w := httptest.NewRecorder()
+		verifyHandler(sm, config)(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: verify status %d", tt.provider, w.Code)
+		}
+		h := w.Header()
+		if h.Get("X-Auth-Request-User") != tt.user || h.Get("X-Auth-Request-Email") != tt.email || h.Get("X-Auth-Request-Provider") != tt.provider {
+			t.Errorf("%s: verify headers %v", tt.provider, h)
+		}
+
+		// The gateway sends them upstream, along with the identity JWT
+		r = providerRequest(t, sm, "/reports", tt.provider, tt.token, profile)
+		r.Header.Set("X-Forwarded-Provider", "forged")
+		w = httptest.NewRecorder()
+		gatewayProxy(sm, config).ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: gateway status %d", tt.provider, w.Code)
+		}
+		if upstreamHeaders.Get("X-Forwarded-User") != tt.user || upstreamHeaders.Get("X-Forwarded-Email") != tt.email || upstreamHeaders.Get("X-Forwarded-Provider") != tt.provider {
+			t.Errorf("%s: upstream headers %v", tt.provider, upstreamHeaders)
+		}
+		identity, err := jwt.Parse(upstreamHeaders.Get(defaultGatewayJWTHeader), func(*jwt.Token) (interface{}, error) { return secret, nil })
+		if err != nil {
+			t.Fatalf("%s: %v", tt.provider, err)
+		}
+		claims := identity.Claims
+		if claims["user_name"] != tt.user || claims["email"] != tt.email || claims["idp"] != tt.provider || claims["idp_iss"] != tt.issuer || claims["name"] != "Alice" {
+			t.Errorf("%s: identity claims %v", tt.provider, claims)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// redirectPolicy decides where the app may send the browser. Local paths are
+// always allowed; absolute URLs must point at the app itself, the provider,
+// or one of Hosts.
+type redirectPolicy struct {
+	// Hosts are extra allowed hosts; a leading dot matches every subdomain
+	Hosts []string
+}
+
+// redirectPolicyFromEnv reads REDIRECT_ALLOWED_HOSTS. FORWARD_AUTH_DOMAINS is
+// included because /auth/start returns to those hosts.
+func redirectPolicyFromEnv(settings *Settings) *redirectPolicy {
+	hosts := splitList(settings.Get("REDIRECT_ALLOWED_HOSTS"))
+	hosts = append(hosts, splitList(settings.Get("FORWARD_AUTH_DOMAINS"))...)
+	for i := range hosts {
+		hosts[i] = strings.ToLower(hosts[i])
+	}
+	return &redirectPolicy{Hosts: hosts}
+}
+
+// safeRedirectURL normalizes target and reports whether the browser may be
+// sent there. Protocol-relative paths, backslashes, control characters,
+// credentials and non-http schemes are refused, including when they are
+// percent-encoded.
+func (ac *authConfig) safeRedirectURL(target string) (string, bool) {
+	if len(target) == 0 {
+		return "", false
+	}
+	for _, c := range target {
+		if c < 0x20 || c == 0x7f {
+			return "", false
+		}
+	}
+	// Browsers treat a backslash like a slash, so /\evil.com is //evil.com
+	target = strings.Replace(target, "\\", "/", -1)
+
+	u, err := url.Parse(target)
+	if err != nil || u.User != nil || len(u.Opaque) > 0 {
+		return "", false
+	}
+	if decoded, err := url.QueryUnescape(u.Path); err != nil || strings.HasPrefix(decoded, "//") || strings.Contains(decoded, "\\") {
+		return "", false
+	}
+
+	if len(u.Scheme) == 0 && len(u.Host) == 0 {
+		if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+			return "", false
+		}
+		return u.String(), true
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if (scheme != "http" && scheme != "https") || len(u.Host) == 0 {
+		return "", false
+	}
+	if !ac.allowedRedirectHost(u.Host) {
+		return "", false
+	}
+	u.Scheme = scheme
+	return u.String(), true
+}
+
+// safeReturnTo checks a return address supplied by the browser. Unlike the
+// app's own redirects it is also bounded in length, since it is kept in the
+// session until the login completes.
+func (ac *authConfig) safeReturnTo(target string) (string, bool) {
+	if len(target) > maxReturnToLength {
+		return "", false
+	}
+	return ac.safeRedirectURL(target)
+}
+
+// allowedRedirectHost reports whether host is the app, the provider or one of
+// the configured hosts.
+func (ac *authConfig) allowedRedirectHost(host string) bool {
+	host = hostname(host)
+	if len(host) == 0 {
+		return false
+	}
+	known := []string{ac.CallbackURL}
+	if endpoints := ac.endpoints(); endpoints != nil {
+		known = append(known, endpoints.Authorization, endpoints.EndSession)
+	}
+	for _, k := range known {
+		if u, err := url.Parse(k); err == nil && len(u.Host) > 0 && hostname(u.Host) == host {
+			return true
+		}
+	}
+	for _, allowed := range ac.Redirects.Hosts {
+		if host == allowed || (strings.HasPrefix(allowed, ".") && (strings.HasSuffix(host, allowed) || host == allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// redirect sends the browser to target with a 302. Targets refused by the
+// redirect policy send it to the home page instead.
+func (ac *authConfig) redirect(w http.ResponseWriter, r *http.Request, target string) {
+	safe, ok := ac.safeRedirectURL(target)
+	if !ok {
+		fmt.Printf("Refused redirect to %q\n", target)
+		safe = "/"
+	}
+	http.Redirect(w, r, safe, http.StatusFound)
+}
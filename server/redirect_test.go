@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSafeRedirectURL(t *testing.T) {
+	config := newTestConfig()
+	config.Redirects = &redirectPolicy{Hosts: []string{"docs.example.org", ".apps.example.net"}}
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/protected/user", "/protected/user"},
+		{"/protected/user?tab=1#top", "/protected/user?tab=1#top"},
+		{"https://app.example.com/protected/user", "https://app.example.com/protected/user"},
+		{"HTTPS://login.example.com/logout.do", "https://login.example.com/logout.do"},
+		{"https://docs.example.org/", "https://docs.example.org/"},
+		{"https://a.apps.example.net/x", "https://a.apps.example.net/x"},
+		{"https://apps.example.net/x", "https://apps.example.net/x"},
+		{"//evil.com", ""},
+		{"///evil.com", ""},
+		{"/\\evil.com", ""},
+		{"\\\\evil.com", ""},
+		{"/%2F/evil.com", ""},
+		{"/%5Cevil.com", ""},
+		{"https://evil.com/", ""},
+		{"https://app.example.com.evil.com/", ""},
+		{"https://evilapps.example.net/", ""},
+		{"https://app.example.com@evil.com/", ""},
+		{"javascript:alert(1)", ""},
+		{"data:text/html,hi", ""},
+		{"https:evil.com", ""},
+		{"relative/path", ""},
+		{"/path\nLocation: https://evil.com", ""},
+		{"/path\t", ""},
+		{"", ""},
+		{"/" + strings.Repeat("a", maxReturnToLength), "/" + strings.Repeat("a", maxReturnToLength)},
+	}
+	for _, tt := range tests {
+		got, ok := config.safeRedirectURL(tt.target)
+		if ok != (len(tt.want) > 0) || got != tt.want {
+			t.Errorf("%q: got %q, %v; want %q", tt.target, got, ok, tt.want)
+		}
+	}
+}
+
+func TestRedirectFallsBackToHome(t *testing.T) {
+	config := newTestConfig()
+	w := httptest.NewRecorder()
+	config.redirect(w, httptest.NewRequest("GET", "/", nil), "/\\evil.com")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestSafeReturnTo(t *testing.T) {
+	config := newTestConfig()
+	long := "/" + strings.Repeat("a", maxReturnToLength)
+	if got, ok := config.safeReturnTo("/protected/user"); !ok || got != "/protected/user" {
+		t.Errorf("got %q, %v", got, ok)
+	}
+	if _, ok := config.safeReturnTo(long); ok {
+		t.Error("accepted a return address longer than maxReturnToLength")
+	}
+	if _, ok := config.safeReturnTo("//evil.com"); ok {
+		t.Error("accepted an unsafe return address")
+	}
+}
+
+func TestRedirectToLongProviderURL(t *testing.T) {
+	config := newTestConfig()
+	config.Logout = &logoutConfig{LandingURL: "https://app.example.com/", EndSession: true}
+	idToken := strings.Repeat("a", 4*maxReturnToLength)
+	w := httptest.NewRecorder()
+	config.redirect(w, httptest.NewRequest("GET", "/logout", nil), endSessionURL(config, idToken))
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, "https://login.example.com/logout.do?") || !strings.Contains(location, idToken) {
+		t.Fatalf("redirected to %.80q", location)
+	}
+}
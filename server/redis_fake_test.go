@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for a redis server. It speaks enough of
+// the RESP protocol for the session provider, which lets the tests exercise
+// the redis session code path without a real server.
+type fakeRedis struct {
+	lock    sync.Mutex
+	values  map[string]string
+	sets    map[string]map[string]bool
+	expires map[string]time.Time
+}
+
+type fakeRedisCommand func(f *fakeRedis, args []string) interface{}
+
+var fakeRedisCommands = map[string]fakeRedisCommand{
+	"PING":     (*fakeRedis).ping,
+	"AUTH":     (*fakeRedis).ok,
+	"SELECT":   (*fakeRedis).ok,
+	"GET":      (*fakeRedis).get,
+	"SET":      (*fakeRedis).set,
+	"SETEX":    (*fakeRedis).setex,
+	"EXISTS":   (*fakeRedis).exists,
+	"DEL":      (*fakeRedis).del,
+	"EXPIRE":   (*fakeRedis).expire,
+	"RENAME":   (*fakeRedis).rename,
+	"SADD":     (*fakeRedis).sadd,
+	"SREM":     (*fakeRedis).srem,
+	"SMEMBERS": (*fakeRedis).smembers,
+}
+
+var fakeRedisArity = map[string]int{
+	"PING": 0, "AUTH": 1, "SELECT": 1, "GET": 1, "SET": 2,
+	"SETEX": 3, "EXISTS": 1, "DEL": 1, "EXPIRE": 2, "RENAME": 2,
+	"SADD": 2, "SREM": 2, "SMEMBERS": 1,
+}
+
+// startFakeRedis listens on a random loopback port and returns its address.
+func startFakeRedis() (addr string, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	f := &fakeRedis{
+		values:  make(map[string]string),
+		sets:    make(map[string]map[string]bool),
+		expires: make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return l.Addr().String(), nil
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+		args, ok := reply.([]interface{})
+		if !ok || len(args) == 0 {
+			writeFakeRedisReply(conn, redisError("ERR protocol error"))
+			return
+		}
+		strs := make([]string, len(args))
+		for i, arg := range args {
+			b, _ := arg.([]byte)
+			strs[i] = string(b)
+		}
+		if err := writeFakeRedisReply(conn, f.exec(strs)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) exec(args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	cmd, ok := fakeRedisCommands[name]
+	if !ok {
+		return redisError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if arity := fakeRedisArity[name]; len(args)-1 < arity {
+		return redisError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", args[0]))
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return cmd(f, args[1:])
+}
+
+func writeFakeRedisReply(w io.Writer, reply interface{}) error {
+	var s string
+	switch r := reply.(type) {
+	case nil:
+		s = "$-1\r\n"
+	case redisError:
+		s = "-" + string(r) + "\r\n"
+	case int64:
+		s = ":" + strconv.FormatInt(r, 10) + "\r\n"
+	case []byte:
+		s = "+" + string(r) + "\r\n"
+	case string:
+		s = "$" + strconv.Itoa(len(r)) + "\r\n" + r + "\r\n"
+	case []string:
+		s = "*" + strconv.Itoa(len(r)) + "\r\n"
+		for _, item := range r {
+			s += "$" + strconv.Itoa(len(item)) + "\r\n" + item + "\r\n"
+		}
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// live drops key if it has expired and reports whether it still exists.
+func (f *fakeRedis) live(key string) bool {
+	if exp, ok := f.expires[key]; ok && time.Now().After(exp) {
+		delete(f.values, key)
+		delete(f.sets, key)
+		delete(f.expires, key)
+	}
+	_, isValue := f.values[key]
+	_, isSet := f.sets[key]
+	return isValue || isSet
+}
+
+// lookup returns the live string value of key.
+func (f *fakeRedis) lookup(key string) (string, bool) {
+	f.live(key)
+	v, ok := f.values[key]
+	return v, ok
+}
+
+func (f *fakeRedis) ping(args []string) interface{} {
+	return []byte("PONG")
+}
+
+func (f *fakeRedis) ok(args []string) interface{} {
+	return []byte("OK")
+}
+
+func (f *fakeRedis) get(args []string) interface{} {
+	if v, ok := f.lookup(args[0]); ok {
+		return v
+	}
+	return nil
+}
+
+// set supports the EX and XX options.
+func (f *fakeRedis) set(args []string) interface{} {
+	var expires time.Time
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "XX":
+			if !f.live(args[0]) {
+				return nil
+			}
+		case "EX":
+			i++
+			if i == len(args) {
+				return redisError("ERR syntax error")
+			}
+			seconds, err := strconv.Atoi(args[i])
+			if err != nil || seconds <= 0 {
+				return redisError("ERR invalid expire time in 'set' command")
+			}
+			expires = time.Now().Add(time.Duration(seconds) * time.Second)
+		default:
+			return redisError("ERR syntax error")
+		}
+	}
+	f.values[args[0]] = args[1]
+	delete(f.expires, args[0])
+	if !expires.IsZero() {
+		f.expires[args[0]] = expires
+	}
+	return []byte("OK")
+}
+
+func (f *fakeRedis) setex(args []string) interface{} {
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil || seconds <= 0 {
+		return redisError("ERR invalid expire time in 'setex' command")
+	}
+	f.values[args[0]] = args[2]
+	f.expires[args[0]] = time.Now().Add(time.Duration(seconds) * time.Second)
+	return []byte("OK")
+}
+
+func (f *fakeRedis) exists(args []string) interface{} {
+	var n int64
+	for _, key := range args {
+		if f.live(key) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeRedis) del(args []string) interface{} {
+	var n int64
+	for _, key := range args {
+		if f.live(key) {
+			delete(f.values, key)
+			delete(f.sets, key)
+			delete(f.expires, key)
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeRedis) expire(args []string) interface{} {
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil {
+		return redisError("ERR value is not an integer or out of range")
+	}
+	if !f.live(args[0]) {
+		return int64(0)
+	}
+	f.expires[args[0]] = time.Now().Add(time.Duration(seconds) * time.Second)
+	return int64(1)
+}
+
+func (f *fakeRedis) rename(args []string) interface{} {
+	v, ok := f.lookup(args[0])
+	if !ok {
+		return redisError("ERR no such key")
+	}
+	exp, hasExp := f.expires[args[0]]
+	delete(f.values, args[0])
+	delete(f.expires, args[0])
+	f.values[args[1]] = v
+	delete(f.expires, args[1])
+	if hasExp {
+		f.expires[args[1]] = exp
+	}
+	return []byte("OK")
+}
+
+func (f *fakeRedis) sadd(args []string) interface{} {
+	f.live(args[0])
+	set := f.sets[args[0]]
+	if set == nil {
+		set = make(map[string]bool)
+		f.sets[args[0]] = set
+	}
+	var n int64
+	for _, member := range args[1:] {
+		if !set[member] {
+			set[member] = true
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeRedis) srem(args []string) interface{} {
+	f.live(args[0])
+	set := f.sets[args[0]]
+	var n int64
+	for _, member := range args[1:] {
+		if set[member] {
+			delete(set, member)
+			n++
+		}
+	}
+	if set != nil && len(set) == 0 {
+		delete(f.sets, args[0])
+		delete(f.expires, args[0])
+	}
+	return n
+}
+
+func (f *fakeRedis) smembers(args []string) interface{} {
+	f.live(args[0])
+	members := []string{}
+	for member := range f.sets[args[0]] {
+		members = append(members, member)
+	}
+	return members
+}
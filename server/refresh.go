@@ -0,0 +1,190 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/session"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const defaultRefreshMargin = time.Minute
+
+var (
+	errNoRefreshToken = errors.New("access token expired and no refresh token is available")
+	errNoSessionToken = errors.New("no token in session")
+)
+
+// refreshMarginFromEnv reads TOKEN_REFRESH_MARGIN, how long before expiry a
+// token is refreshed.
+func refreshMarginFromEnv(settings *Settings) (time.Duration, error) {
+	return settings.Duration("TOKEN_REFRESH_MARGIN", defaultRefreshMargin)
+}
+
+// refreshLocks serializes refreshes per session within this instance, so
+// parallel requests do not spend a rotating refresh token twice. Instances do
+// not share the lock; sessionToken instead re-reads the stored token and
+// recovers when another instance has already spent the refresh token.
+var refreshLocks keyedLocks
+
+// keyedLocks hands out one mutex per key, so work on one key does not wait
+// for work on another. The zero value is ready to use.
+type keyedLocks struct {
+	sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock takes the mutex for key and returns the function that releases it.
+func (kl *keyedLocks) lock(key string) func() {
+	kl.Lock()
+	if kl.locks == nil {
+		kl.locks = make(map[string]*keyedLock)
+	}
+	l, ok := kl.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		kl.locks[key] = l
+	}
+	l.waiters++
+	kl.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		kl.Lock()
+		if l.waiters--; l.waiters == 0 {
+			delete(kl.locks, key)
+		}
+		kl.Unlock()
+	}
+}
+
+// lockSession serializes token refreshes for the session sid.
+func lockSession(sid string) func() {
+	return refreshLocks.lock(sid)
+}
+
+// needsRefresh reports whether token expires within margin. Tokens without
+// an expiry are never refreshed.
+func needsRefresh(token *oauth2.Token, margin time.Duration) bool {
+	return !token.Expiry.IsZero() && time.Now().Add(margin).After(token.Expiry)
+}
+
+// sessionToken returns the session's token, first refreshing it with the
+// refresh_token grant when it is expired or about to expire. A refreshed
+// token is written back to the session; the caller releases the session.
+// Errors for which refreshRejected is false are transient and must not end
+// the session.
+func sessionToken(sessionManager *session.Manager, sess session.Store, config *authConfig) (*oauth2.Token, error) {
+	defer lockSession(sess.SessionID())()
+
+	// sess was read before the lock was taken, so load the current token
+	token, err := storedToken(sessionManager, sess)
+	if err != nil {
+		return nil, err
+	}
+	if !needsRefresh(token, config.RefreshMargin) {
+		return token, nil
+	}
+	if len(token.RefreshToken) == 0 {
+		return nil, errNoRefreshToken
+	}
+
+	refreshed, err := refreshToken(config.context(), config, token.RefreshToken)
+	if err != nil {
+		if isInvalidGrant(err) {
+			// Another instance may have spent the rotated refresh token first
+			if current, cerr := storedToken(sessionManager, sess); cerr == nil && current.RefreshToken != token.RefreshToken {
+				return current, nil
+			}
+			return nil, err
+		}
+		if !needsRefresh(token, 0) {
+			fmt.Printf("Could not refresh token, using it until it expires: %s\n", err)
+			return token, nil
+		}
+		return nil, err
+	}
+	if len(refreshed.RefreshToken) == 0 {
+		refreshed.RefreshToken = token.RefreshToken
+	}
+
+	jsonToken, err := tokenToJSON(refreshed)
+	if err != nil {
+		return nil, err
+	}
+	sess.Set("token", jsonToken)
+	if idToken, ok := refreshed.Extra("id_token").(string); ok && len(idToken) > 0 {
+		if err := checkRefreshedIDToken(idToken, refreshed.AccessToken, sess, config); err != nil {
+			fmt.Printf("Ignoring ID token from refresh: %s\n", err)
+		} else {
+			sess.Set("id_token", idToken)
+		}
+	}
+	return refreshed, nil
+}
+
+// storedToken returns the token as currently saved in the session store. When
+// another request has replaced it since sess was read, sess is updated too.
+// Cookie sessions have no shared store; re-reading one would only return the
+// request's original cookie.
+func storedToken(sessionManager *session.Manager, sess session.Store) (*oauth2.Token, error) {
+	jsonToken, _ := sess.Get("token").(string)
+	_, cookie := sess.(*session.CookieSessionStore)
+	if stored, err := sessionManager.GetSessionStore(sess.SessionID()); err == nil && !cookie {
+		if current, ok := stored.Get("token").(string); ok && current != jsonToken {
+			jsonToken = current
+			sess.Set("token", current)
+			if idToken, ok := stored.Get("id_token").(string); ok {
+				sess.Set("id_token", idToken)
+			}
+		}
+	}
+	if len(jsonToken) == 0 {
+		return nil, errNoSessionToken
+	}
+	return tokenFromJSON(jsonToken)
+}
+
+// checkRefreshedIDToken validates an ID token returned by a refresh. OpenID
+// Connect Core 12.2 requires the issuer, audience and subject of the original.
+func checkRefreshedIDToken(raw string, accessToken string, sess session.Store, config *authConfig) error {
+	t, err := validateIDToken(raw, accessToken, "", config)
+	if err != nil {
+		return err
+	}
+	profile, _ := sess.Get("profile").(map[string]interface{})
+	if sub, _ := t.Claims["sub"].(string); len(sub) == 0 || profile == nil || sub != profile["sub"] {
+		return &idTokenError{"sub", "does not match the signed in user"}
+	}
+	return nil
+}
+
+// isInvalidGrant reports whether the token endpoint rejected the grant itself.
+func isInvalidGrant(err error) bool {
+	te, ok := err.(*tokenError)
+	return ok && te.Code == "invalid_grant"
+}
+
+// refreshRejected reports whether err means the session can no longer get a
+// token, as opposed to a transient failure such as a network error.
+func refreshRejected(err error) bool {
+	return err == errNoRefreshToken || err == errNoSessionToken || isInvalidGrant(err)
+}
+
+// refreshToken redeems a refresh token at the token endpoint.
+func refreshToken(ctx context.Context, config *authConfig, refreshToken string) (*oauth2.Token, error) {
+	return retrieveToken(ctx, config, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/session"
+	"golang.org/x/oauth2"
+)
+
+// newTokenServer points config at a token endpoint served by handler.
+func newTokenServer(config *authConfig, handler http.HandlerFunc) *httptest.Server {
+	ts := httptest.NewServer(handler)
+	endpoints := *config.staticEndpoints
+	endpoints.Token = ts.URL + "/oauth/token"
+	config.staticEndpoints = &endpoints
+	return ts
+}
+
+// storeTestToken saves a token expiring in expiresIn to the session sid.
+func storeTestToken(t *testing.T, sm *session.Manager, sid string, refresh string, expiresIn time.Duration) session.Store {
+	sess, err := sm.GetSessionStore(sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonToken, _ := tokenToJSON(&oauth2.Token{AccessToken: "access-" + refresh, RefreshToken: refresh, Expiry: time.Now().Add(expiresIn)})
+	sess.Set("token", jsonToken)
+	sess.Set("profile", map[string]interface{}{"sub": "user-1"})
+	sess.SessionRelease(httptest.NewRecorder())
+	return sess
+}
+
+func writeTokenResponse(w http.ResponseWriter, refresh string, idToken string) {
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{
+		"access_token":  "access-" + refresh,
+		"token_type":    "bearer",
+		"refresh_token": refresh,
+		"expires_in":    3600,
+	}
+	if len(idToken) > 0 {
+		resp["id_token"] = idToken
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestSessionTokenRefresh(t *testing.T) {
+	otherUser := idTokenClaims()
+	otherUser["sub"] = "user-2"
+
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		respond   func(w http.ResponseWriter)
+		access    string
+		idToken   bool
+		rejected  bool
+		transient bool
+	}{
+		{name: "fresh token is not refreshed", expiresIn: time.Hour, access: "access-r1"},
+		{name: "expiring token is refreshed", expiresIn: time.Second, access: "access-r2", idToken: true, respond: func(w http.ResponseWriter) {
+			writeTokenResponse(w, "r2", signTestToken(t, idTokenClaims(), nil, nil))
+		}},
+		{name: "id token for another user is dropped", expiresIn: time.Second, access: "access-r2", respond: func(w http.ResponseWriter) {
+			writeTokenResponse(w, "r2", signTestToken(t, otherUser, nil, nil))
+		}},
+		{name: "invalid_grant ends the session", expiresIn: time.Second, rejected: true, respond: func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+		}},
+		{name: "outage keeps a still valid token", expiresIn: 30 * time.Second, access: "access-r1", respond: func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusBadGateway)
+		}},
+		{name: "outage with an expired token is transient", expiresIn: -time.Second, transient: true, respond: func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusBadGateway)
+		}},
+	}
+	for _, tt := range tests {
+		config := newTestConfig()
+		calls := 0
+		ts := newTokenServer(config, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if r.PostFormValue("refresh_token") != "r1" {
+				t.Errorf("%s: refreshed with %q", tt.name, r.PostFormValue("refresh_token"))
+			}
+			tt.respond(w)
+		})
+		sm := newTestRedisManager(t, 60)
+		sess := storeTestToken(t, sm, "sid", "r1", tt.expiresIn)
+
+		token, err := sessionToken(sm, sess, config)
+		ts.Close()
+		switch {
+		case tt.rejected || tt.transient:
+			if err == nil || refreshRejected(err) != tt.rejected {
+				t.Errorf("%s: error = %v, rejected = %v", tt.name, err, refreshRejected(err))
+			}
+			continue
+		case err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if token.AccessToken != tt.access {
+			t.Errorf("%s: access token = %s, want %s", tt.name, token.AccessToken, tt.access)
+		}
+		if tt.respond == nil && calls > 0 {
+			t.Errorf("%s: called the token endpoint", tt.name)
+		}
+		if _, ok := sess.Get("id_token").(string); ok != tt.idToken {
+			t.Errorf("%s: id_token stored = %v", tt.name, ok)
+		}
+	}
+}
+
+func TestSessionTokenUsesTokenRefreshedElsewhere(t *testing.T) {
+	config := newTestConfig()
+	ts := newTokenServer(config, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("token endpoint called although the stored token is fresh")
+	})
+	defer ts.Close()
+	sm := newTestRedisManager(t, 60)
+
+	// This request read the session before another instance refreshed it
+	stale := storeTestToken(t, sm, "sid", "r1", time.Second)
+	storeTestToken(t, sm, "sid", "r2", time.Hour)
+
+	token, err := sessionToken(sm, stale, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.RefreshToken != "r2" {
+		t.Fatalf("got refresh token %s, want r2", token.RefreshToken)
+	}
+}
+
+func TestSessionTokenRecoversFromLostRefreshRace(t *testing.T) {
+	config := newTestConfig()
+	sm := newTestRedisManager(t, 60)
+	ts := newTokenServer(config, func(w http.ResponseWriter, r *http.Request) {
+		// Another instance spends r1 and stores r2 while this request waits
+		storeTestToken(t, sm, "sid", "r2", time.Hour)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+	})
+	defer ts.Close()
+
+	sess := storeTestToken(t, sm, "sid", "r1", time.Second)
+	token, err := sessionToken(sm, sess, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.RefreshToken != "r2" {
+		t.Fatalf("got refresh token %s, want r2", token.RefreshToken)
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const (
+	revocationAttempts = 3
+	revocationBackoff  = 500 * time.Millisecond
+	// revocationTimeout bounds the revocation work done inside one request
+	revocationTimeout = 10 * time.Second
+)
+
+var errNoRevocationEndpoint = errors.New("the provider has no revocation endpoint")
+
+// revocationError is a non-200 response from the revocation endpoint.
+type revocationError struct {
+	Status string
+	Code   int
+}
+
+func (e *revocationError) Error() string {
+	return "revocation endpoint returned " + e.Status
+}
+
+// retryable reports whether the provider may accept the same request later.
+func (e *revocationError) retryable() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
+
+// revokeToken revokes token at the provider's RFC 7009 revocation endpoint.
+// hint is "access_token" or "refresh_token".
+func revokeToken(ctx context.Context, config *authConfig, token string, hint string) error {
+	endpoint := config.endpoints().Revocation
+	if len(endpoint) == 0 {
+		return errNoRevocationEndpoint
+	}
+	client, ok := ctx.Value(oauth2.HTTPClient).(*http.Client)
+	if !ok {
+		client = http.DefaultClient
+	}
+
+	v := url.Values{"token": {token}}
+	if len(hint) > 0 {
+		v.Set("token_type_hint", hint)
+	}
+	req, err := config.newFormRequest(endpoint, v)
+	if err != nil {
+		return err
+	}
+	req.Cancel = ctx.Done()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	// The RFC treats revoking an invalid or unknown token as success
+	if resp.StatusCode != http.StatusOK {
+		return &revocationError{Status: resp.Status, Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// revokeWithRetry calls revokeToken, retrying network failures and 5xx or
+// 429 responses with exponential backoff until ctx is done. The outcome is
+// logged.
+func revokeWithRetry(ctx context.Context, config *authConfig, token string, hint string) error {
+	var err error
+	for attempt := 1; attempt <= revocationAttempts; attempt++ {
+		err = revokeToken(ctx, config, token, hint)
+		if err == nil {
+			fmt.Printf("Revoked %s (attempt %d)\n", hint, attempt)
+			return nil
+		}
+		if err == errNoRevocationEndpoint {
+			break
+		}
+		if re, ok := err.(*revocationError); ok && !re.retryable() {
+			break
+		}
+		if attempt < revocationAttempts {
+			select {
+			case <-time.After(revocationBackoff << uint(attempt-1)):
+			case <-ctx.Done():
+				fmt.Printf("Gave up revoking %s: %s\n", hint, err)
+				return ctx.Err()
+			}
+		}
+	}
+	fmt.Printf("Error revoking %s: %s\n", hint, err)
+	return err
+}
+
+// revokeSessionTokens revokes the refresh and access token stored as JSON in
+// a session. The refresh token goes first, so it cannot mint new access tokens.
+func revokeSessionTokens(ctx context.Context, config *authConfig, jsonToken string) error {
+	token, err := tokenFromJSON(jsonToken)
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, config.HTTPClient)
+	var firstErr error
+	if len(token.RefreshToken) > 0 {
+		firstErr = revokeWithRetry(ctx, config, token.RefreshToken, "refresh_token")
+	}
+	if err := revokeWithRetry(ctx, config, token.AccessToken, "access_token"); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// requestContext returns a context that is done after timeout or when the
+// client of the request behind w goes away.
+func requestContext(w http.ResponseWriter, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed := cn.CloseNotify()
+		go func() {
+			select {
+			case <-closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
@@ -4,48 +4,89 @@ import (
 	"log"
 	"os"
 
-	"github.com/astaxie/beego/session"
-	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
 )
 
 //NewServer configures and returns a Negroni server
-func NewServer(appEnv *cfenv.App) *negroni.Negroni {
-
+func NewServer(settings *Settings) *negroni.Negroni {
 	// set up the authConfig object which contains key values from SSO tile
-	config := initOAuthConfig(appEnv)
+	config := initOAuthConfig(settings)
+
+	// set up the session store; use redis or cookie sessions when running more than one instance
+	sessionConfig, err := initSessionConfig(settings)
+	config.appendError(err)
+
+	// Report every configuration problem at once
 	if config.hasErrors() {
+		log.Printf("Configuration sources: %s\n", settings.Describe())
+		log.Printf("Found %d configuration errors:\n", len(config.Errors))
 		for _, err := range config.Errors {
-			log.Fatalf("OAuth Configuration Error: %s\n", err)
+			log.Printf("  - %s\n", err)
 		}
 		os.Exit(1)
 	}
 
-	//HACK: Current implementation does not scale in cloud environment. Update to use externalized sessions (e.g. Redis)
-	sessionManager, _ := session.NewManager("memory", `{"cookieName":"gosessionid","gclifetime":3600}`)
+	sessionManager, err := newSessionManager(sessionConfig)
+	if err != nil {
+		log.Fatalf("Could not create %s session store: %s\n", sessionConfig.Provider, err)
+	}
 	go sessionManager.GC()
 
+	// Every provider shares the index of user sessions
+	index := newSessionIndex(sessionConfig)
+	for _, p := range config.Providers.list {
+		p.SessionIndex = index
+	}
+
 	n := negroni.Classic()
 	router := mux.NewRouter()
 
 	// Public Routes
-	router.HandleFunc("/", homeHandler(config))
+	if config.Gateway == nil {
+		router.HandleFunc("/", homeHandler(config))
+	}
+	router.HandleFunc("/login", loginHandler(sessionManager, config))
 	router.HandleFunc("/unauthorized", unauthorizedHandler())
 	router.HandleFunc("/callback", callbackHandler(sessionManager, config))
+	router.HandleFunc("/callback/{provider}", callbackHandler(sessionManager, config))
+	router.HandleFunc("/logout", logoutHandler(sessionManager, config))
+
+	// Forward auth endpoints for external proxies
+	router.HandleFunc("/auth/verify", verifyHandler(sessionManager, config))
+	router.HandleFunc("/auth/start", authStartHandler(sessionManager, config))
 
 	// Protected Routes
 	secure := mux.NewRouter()
 	secure.HandleFunc("/protected/user", userHandler(sessionManager, config))
-	secure.HandleFunc("/protected/access", accessHandler(sessionManager, config))
-	secure.HandleFunc("/protected/admin", adminHandler(sessionManager, config))
+	secure.HandleFunc("/protected/access", accessHandler())
+	secure.HandleFunc("/protected/admin", adminHandler())
+	secure.HandleFunc("/protected/admin/revoke", revokeUserHandler(sessionManager, config))
 	secure.HandleFunc("/protected/backing", backingServiceHandler(sessionManager, config))
+	secure.PathPrefix("/protected/services/{name}/").Handler(serviceProxyHandler(sessionManager, config))
 
 	router.PathPrefix("/protected").Handler(negroni.New(
-		negroni.HandlerFunc(isAuthenticated(sessionManager)),
+		negroni.HandlerFunc(isAuthenticated(sessionManager, config)),
+		negroni.HandlerFunc(refreshSessionToken(sessionManager, config)),
+		negroni.HandlerFunc(authorize(sessionManager, config)),
 		negroni.Wrap(secure),
 	))
 
+	// API Routes, authenticated with a Bearer access token instead of a session
+	api := mux.NewRouter()
+	api.HandleFunc("/api/me", apiUserHandler())
+
+	router.PathPrefix("/api").Handler(negroni.New(
+		negroni.HandlerFunc(requireBearer(config)),
+		negroni.Wrap(api),
+	))
+
+	// Gateway mode forwards every other path to the upstream app
+	if config.Gateway != nil {
+		log.Printf("Proxying unmatched paths to %s\n", config.Gateway.Upstream)
+		router.NotFoundHandler = gatewayHandler(sessionManager, config)
+	}
+
 	n.UseHandler(router)
 	return n
 }
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/session"
+	"github.com/cloudfoundry-community/go-cfenv"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultBackingService = "backing"
+	defaultServiceTimeout = 10 * time.Second
+	backingServiceTag     = "backing-service"
+	servicesPrefix        = "/protected/services/"
+)
+
+// Token strategies decide which access token is sent to a backing service.
+const (
+	// strategyForward sends the signed-in user's access token, exchanged for
+	// the service's audience first when TOKEN_EXCHANGE is on
+	strategyForward = "forward"
+	// strategyExchange sends the user's token exchanged for the service's audience
+	strategyExchange = "exchange"
+	// strategyClient sends the app's own client credentials token
+	strategyClient = "client_credentials"
+	// strategyNone sends no token
+	strategyNone = "none"
+)
+
+// errServicePath refuses a path that could leave a service's base URL.
+var errServicePath = errors.New("The path is not allowed for backing services.")
+
+// hopHeaders are not forwarded by the service proxy in either direction.
+// Cookie and Authorization carry this app's credentials, not the service's.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Cookie", "Set-Cookie", "Authorization",
+}
+
+// backingService is a named downstream API the app calls on behalf of users.
+type backingService struct {
+	Name string `json:"-"`
+	// URL is the service's base URL; proxied paths are appended to it
+	URL string `json:"url"`
+	// Timeout bounds a whole call, including reading the response
+	Timeout time.Duration `json:"-"`
+	// Scopes must all be present in the user's token to use the service
+	Scopes []string `json:"-"`
+	// Strategy is one of forward, exchange, client_credentials or none
+	Strategy string `json:"token_strategy"`
+	// Audience is the exchanged token's audience; defaults to the name
+	Audience string `json:"audience"`
+}
+
+// serviceRegistry holds the backing services by name.
+type serviceRegistry map[string]*backingService
+
+// servicesFromEnv builds the registry from bound user-provided services, or
+// services tagged "backing-service", that carry a url credential, overridden
+// by the JSON object in BACKING_SERVICES. Without any configuration the
+// sample's backing service is registered under the name "backing".
+func servicesFromEnv(settings *Settings) (serviceRegistry, error) {
+	registry := serviceRegistry{
+		defaultBackingService: {
+			Name:     defaultBackingService,
+			URL:      "https://oauth-backing-service.apps.pcf.local",
+			Timeout:  defaultServiceTimeout,
+			Strategy: strategyForward,
+		},
+	}
+	if appEnv := settings.appEnv; appEnv != nil {
+		var bound []cfenv.Service
+		if services, err := appEnv.Services.WithLabel("user-provided"); err == nil {
+			bound = append(bound, services...)
+		}
+		if services, err := appEnv.Services.WithTag(backingServiceTag); err == nil {
+			bound = append(bound, services...)
+		}
+		for _, s := range bound {
+			if _, ok := s.Credentials["url"]; !ok {
+				continue
+			}
+			svc, err := newBackingService(s.Name, s.Credentials)
+			if err != nil {
+				return nil, err
+			}
+			registry[s.Name] = svc
+		}
+	}
+
+	if v := settings.Get("BACKING_SERVICES"); len(v) > 0 {
+		var services map[string]map[string]interface{}
+		if err := json.Unmarshal([]byte(v), &services); err != nil {
+			return nil, fmt.Errorf("Could not parse BACKING_SERVICES: %s", err)
+		}
+		for name, values := range services {
+			svc, err := newBackingService(name, values)
+			if err != nil {
+				return nil, err
+			}
+			registry[name] = svc
+		}
+	}
+	return registry, nil
+}
+
+// newBackingService reads url, timeout, scopes, token_strategy and audience
+// from a service's credentials or settings.
+func newBackingService(name string, settings map[string]interface{}) (*backingService, error) {
+	svc := &backingService{Name: name, Timeout: defaultServiceTimeout, Strategy: strategyForward}
+	svc.URL, _ = settings["url"].(string)
+	u, err := url.Parse(svc.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("Backing service %s needs an absolute http(s) url, not %q", name, svc.URL)
+	}
+	svc.URL = strings.TrimSuffix(svc.URL, "/")
+
+	switch timeout := settings["timeout"].(type) {
+	case nil:
+	case string:
+		if svc.Timeout, err = time.ParseDuration(timeout); err != nil || svc.Timeout <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %q for backing service %s", timeout, name)
+		}
+	case float64:
+		svc.Timeout = time.Duration(timeout * float64(time.Second))
+	default:
+		return nil, fmt.Errorf("Invalid timeout for backing service %s", name)
+	}
+
+	switch scopes := settings["scopes"].(type) {
+	case string:
+		svc.Scopes = strings.Fields(strings.Replace(scopes, ",", " ", -1))
+	default:
+		svc.Scopes = claimStrings(scopes)
+	}
+
+	if strategy, ok := settings["token_strategy"].(string); ok && len(strategy) > 0 {
+		svc.Strategy = strategy
+	}
+	switch svc.Strategy {
+	case strategyForward, strategyExchange, strategyClient, strategyNone:
+	default:
+		return nil, fmt.Errorf("Unknown token_strategy %q for backing service %s", svc.Strategy, name)
+	}
+	svc.Audience, _ = settings["audience"].(string)
+	if len(svc.Audience) == 0 {
+		svc.Audience = name
+	}
+	return svc, nil
+}
+
+// names returns the registered service names in order.
+func (sr serviceRegistry) names() []string {
+	var names []string
+	for name := range sr {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// accessToken returns the token to send to the service for the user holding
+// token, or an empty string for services that take no token or get the app's
+// own token from the service client.
+func (svc *backingService) accessToken(config *authConfig, token *oauth2.Token) (string, error) {
+	switch svc.Strategy {
+	case strategyNone, strategyClient:
+		return "", nil
+	case strategyExchange:
+		return config.exchangedToken(token, svc.Audience, nil)
+	}
+	return config.downstreamToken(token, svc.Audience, nil)
+}
+
+// servicePath checks the escaped path p before it is appended to a service's
+// base URL. Dot segments, also when escaped once more, and escaped slashes are
+// refused: the service or a proxy in front of it may decode them again and
+// resolve the path outside the base URL.
+func servicePath(p string) error {
+	for _, segment := range strings.Split(p, "/") {
+		decoded, err := url.QueryUnescape(strings.Replace(segment, "+", "%2B", -1))
+		if err != nil || strings.ContainsAny(decoded, "/\\") {
+			return errServicePath
+		}
+		twice, _ := url.QueryUnescape(strings.Replace(decoded, "+", "%2B", -1))
+		if decoded == "." || decoded == ".." || twice == "." || twice == ".." {
+			return errServicePath
+		}
+	}
+	return nil
+}
+
+// do sends req, whose URL is relative to the service's base URL, with the
+// token chosen by the service's strategy.
+func (svc *backingService) do(config *authConfig, token *oauth2.Token, req *http.Request) (*http.Response, error) {
+	rel := req.URL.EscapedPath()
+	if err := servicePath(rel); err != nil {
+		return nil, err
+	}
+	target, err := url.Parse(svc.URL)
+	if err != nil {
+		return nil, err
+	}
+	// req.URL.Path is already decoded, so the escaped form is joined as is
+	base := strings.TrimSuffix(target.EscapedPath(), "/")
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(req.URL.Path, "/")
+	target.RawPath = base + "/" + strings.TrimPrefix(rel, "/")
+	target.RawQuery = req.URL.RawQuery
+	req.URL = target
+	req.Host = target.Host
+
+	accessToken, err := svc.accessToken(config, token)
+	if err != nil {
+		return nil, &serviceTokenError{err}
+	}
+	if len(accessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	client := config.clientWithTimeout(svc.Timeout)
+	if svc.Strategy == strategyClient {
+		client = config.serviceClient()
+		client.Timeout = svc.Timeout
+	}
+	return client.Do(req)
+}
+
+// authorize checks that token carries all of the service's scopes. Otherwise
+// it writes the rejection and returns false.
+func (svc *backingService) authorize(w http.ResponseWriter, r *http.Request, config *authConfig, provider *authConfig, token *oauth2.Token) bool {
+	if len(svc.Scopes) == 0 {
+		return true
+	}
+	accessToken, err := parseToken(token.AccessToken, provider)
+	if err != nil {
+		rejectToken(w, r, config, err)
+		return false
+	}
+	if !hasAllScopes(accessToken, svc.Scopes...) {
+		errorPage(w, http.StatusForbidden, "Access Denied", fmt.Sprintf("Calling %s requires the scopes %s.", svc.Name, strings.Join(svc.Scopes, ", ")))
+		return false
+	}
+	return true
+}
+
+// serviceTokenError means no token could be obtained for the service.
+type serviceTokenError struct {
+	err error
+}
+
+func (e *serviceTokenError) Error() string {
+	return "could not obtain a token for the backing service: " + e.err.Error()
+}
+
+// serviceProxyHandler forwards /protected/services/{name}/... to the named
+// backing service and streams the response back.
+func serviceProxyHandler(sessionManager *session.Manager, config *authConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		svc, ok := config.Services[name]
+		if !ok {
+			errorPage(w, http.StatusNotFound, "Unknown Service", fmt.Sprintf("There is no backing service named %q.", name))
+			return
+		}
+
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" && crossOrigin(r) {
+			http.Error(w, "Cross-origin request refused", http.StatusForbidden)
+			return
+		}
+
+		token, provider, err := tokenFromSession(sessionManager, w, r, config)
+		if err != nil {
+			config.redirect(w, r, "/unauthorized")
+			return
+		}
+		if !svc.authorize(w, r, config, provider, token) {
+			return
+		}
+
+		req, err := http.NewRequest(r.Method, "", r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.URL.Path = strings.TrimPrefix(r.URL.Path, servicesPrefix+name)
+		req.URL.RawPath = strings.TrimPrefix(r.URL.EscapedPath(), servicesPrefix+name)
+		req.URL.RawQuery = r.URL.RawQuery
+		req.ContentLength = r.ContentLength
+		copyHeaders(req.Header, r.Header)
+		if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			req.Header.Set("X-Forwarded-For", clientIP)
+		}
+
+		resp, err := svc.do(provider, token, req)
+		if err == errServicePath {
+			fmt.Printf("Refused path %q for backing service %s\n", r.URL.EscapedPath(), name)
+			errorPage(w, http.StatusBadRequest, "Bad Request", err.Error())
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error calling backing service %s: %s\n", name, err)
+			status := http.StatusBadGateway
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				status = http.StatusGatewayTimeout
+			}
+			errorPage(w, status, "Backing Service Unavailable", fmt.Sprintf("The %s service could not be reached.", name))
+			return
+		}
+		defer resp.Body.Close()
+
+		copyHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			fmt.Printf("Error streaming response from backing service %s: %s\n", name, err)
+		}
+	}
+}
+
+// copyHeaders copies src to dst, leaving out hop-by-hop and credential headers.
+func copyHeaders(dst http.Header, src http.Header) {
+	for key, values := range src {
+		if containsString(hopHeaders, http.CanonicalHeaderKey(key)) {
+			continue
+		}
+		for _, v := range values {
+			dst.Add(key, v)
+		}
+	}
+}
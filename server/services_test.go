@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+func TestServiceScopes(t *testing.T) {
+	var authorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	config := newTestConfig()
+	config.Exchange = &tokenExchange{}
+	config.Providers = &providerRegistry{list: []*authConfig{config}, byName: map[string]*authConfig{config.Name: config}}
+	svc := &backingService{Name: defaultBackingService, URL: upstream.URL, Timeout: defaultServiceTimeout, Strategy: strategyForward, Scopes: []string{"test.admin"}}
+	config.Services = serviceRegistry{defaultBackingService: svc}
+	sm := newTestSessionManager(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/protected/backing", backingServiceHandler(sm, config))
+	router.PathPrefix("/protected/services/{name}/").Handler(serviceProxyHandler(sm, config))
+
+	admin := signTestToken(t, accessTokenClaims("test.admin"), nil, nil)
+	access := signTestToken(t, accessTokenClaims("test.access"), nil, nil)
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		origin string
+		status int
+	}{
+		{"backing page with scope", "GET", "/protected/backing", admin, "", http.StatusOK},
+		{"backing page without scope", "GET", "/protected/backing", access, "", http.StatusForbidden},
+		{"proxy with scope", "GET", "/protected/services/backing/api/hello", admin, "", http.StatusOK},
+		{"proxy without scope", "GET", "/protected/services/backing/api/hello", access, "", http.StatusForbidden},
+		{"same origin post", "POST", "/protected/services/backing/api/hello", admin, "https://example.com", http.StatusOK},
+		{"cross origin post", "POST", "/protected/services/backing/api/hello", admin, "https://evil.example.com", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		authorization = ""
+		r := loggedInRequest(t, sm, tt.method, tt.target, &oauth2.Token{AccessToken: tt.token})
+		if len(tt.origin) > 0 {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+			continue
+		}
+		if tt.status == http.StatusOK && authorization != "Bearer "+tt.token {
+			t.Errorf("%s: upstream got Authorization %q", tt.name, authorization)
+		}
+		if tt.status != http.StatusOK && len(authorization) > 0 {
+			t.Errorf("%s: upstream was called", tt.name)
+		}
+		if tt.status == http.StatusOK && !strings.Contains(w.Body.String(), "hello") {
+			t.Errorf("%s: body %q", tt.name, w.Body.String())
+		}
+	}
+}
+
+func TestServiceProxyPaths(t *testing.T) {
+	var requested string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.RequestURI
+	}))
+	defer upstream.Close()
+
+	config := newTestConfig()
+	config.Exchange = &tokenExchange{}
+	config.Providers = &providerRegistry{list: []*authConfig{config}, byName: map[string]*authConfig{config.Name: config}}
+	svc := &backingService{Name: defaultBackingService, URL: upstream.URL + "/api/v1", Timeout: defaultServiceTimeout, Strategy: strategyForward}
+	config.Services = serviceRegistry{defaultBackingService: svc}
+	sm := newTestSessionManager(t)
+	router := mux.NewRouter()
+	router.PathPrefix("/protected/services/{name}/").Handler(serviceProxyHandler(sm, config))
+	token := &oauth2.Token{AccessToken: signTestToken(t, accessTokenClaims("test.access"), nil, nil)}
+
+	tests := []struct {
+		target string
+		status int
+		want   string
+	}{
+		{"/protected/services/backing/reports?year=2016", http.StatusOK, "/api/v1/reports?year=2016"},
+		{"/protected/services/backing/reports/a%20b", http.StatusOK, "/api/v1/reports/a%20b"},
+		{"/protected/services/backing/reports/100%25", http.StatusOK, "/api/v1/reports/100%25"},
+		// mux cleans dot segments after decoding once; the proxy refuses the rest
+		{"/protected/services/backing/%2e%2e/internal/admin", http.StatusMovedPermanently, ""},
+		{"/protected/services/backing/%252e%252e/%252e%252e/internal/admin", http.StatusBadRequest, ""},
+		{"/protected/services/backing/reports/2016%2Finternal", http.StatusBadRequest, ""},
+		{"/protected/services/backing/reports%5c..%5cinternal", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		requested = ""
+		r := loggedInRequest(t, sm, "GET", "/", token)
+		r.URL, _ = url.ParseRequestURI(tt.target)
+		r.RequestURI = tt.target
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.status || requested != tt.want {
+			t.Errorf("%s: status %d, upstream got %q; want %d, %q", tt.target, w.Code, requested, tt.status, tt.want)
+		}
+	}
+}
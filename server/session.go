@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/astaxie/beego/session"
+	"github.com/cloudfoundry-community/go-cfenv"
+	"github.com/gorilla/context"
+)
+
+const (
+	sessionCookieName      = "gosessionid"
+	defaultSessionLifetime = 3600
+	// maxCookieSize is the most browsers store for one cookie, attributes included
+	maxCookieSize = 4096
+)
+
+var errSessionTooLarge = errors.New("the session does not fit in a cookie; use SESSION_PROVIDER=redis for providers that issue large tokens")
+
+type sessionConfig struct {
+	Provider string
+	Lifetime int64
+	Secure   bool
+	FilePath string
+	HashKey  string
+	BlockKey string
+	RedisURL string
+}
+
+// managerConfig mirrors the JSON document accepted by session.NewManager.
+type managerConfig struct {
+	CookieName     string `json:"cookieName"`
+	Gclifetime     int64  `json:"gclifetime"`
+	Maxlifetime    int64  `json:"maxLifetime"`
+	Secure         bool   `json:"secure"`
+	ProviderConfig string `json:"providerConfig"`
+}
+
+// cookieProviderConfig mirrors the providerConfig accepted by the beego cookie provider.
+type cookieProviderConfig struct {
+	SecurityKey  string `json:"securityKey"`
+	BlockKey     string `json:"blockKey"`
+	SecurityName string `json:"securityName"`
+	CookieName   string `json:"cookieName"`
+	Secure       bool   `json:"secure"`
+	Maxage       int    `json:"maxage"`
+}
+
+// initSessionConfig reads the session backend settings from the environment.
+// Supported providers are memory (default), file, cookie and redis. A redis
+// store is located through SESSION_REDIS_URL or a bound service tagged "redis".
+func initSessionConfig(settings *Settings) (config *sessionConfig, err error) {
+	config = &sessionConfig{
+		Provider: settings.Get("SESSION_PROVIDER"),
+		Lifetime: defaultSessionLifetime,
+		FilePath: settings.Get("SESSION_FILE_PATH"),
+		HashKey:  settings.Get("SESSION_HASH_KEY"),
+		BlockKey: settings.Get("SESSION_BLOCK_KEY"),
+		RedisURL: settings.Get("SESSION_REDIS_URL"),
+	}
+	if len(config.Provider) == 0 {
+		config.Provider = "memory"
+	}
+	if lifetime := settings.Get("SESSION_LIFETIME"); len(lifetime) > 0 {
+		config.Lifetime, err = strconv.ParseInt(lifetime, 10, 64)
+		if err != nil || config.Lifetime <= 0 {
+			return nil, invalidSetting(settings, "SESSION_LIFETIME", lifetime, "a positive number of seconds")
+		}
+	}
+	if config.Secure, err = settings.Bool("SESSION_SECURE_COOKIE", false); err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(config.Provider) {
+	case "memory":
+	case "file":
+		if len(config.FilePath) == 0 {
+			config.FilePath = filepath.Join(os.TempDir(), "oauth-authcode-sessions")
+		}
+	case "cookie":
+		if len(config.HashKey) == 0 || len(config.BlockKey) == 0 {
+			return nil, errors.New("Cookie sessions require SESSION_HASH_KEY and SESSION_BLOCK_KEY so every instance can read them.")
+		}
+		switch len(config.BlockKey) {
+		case 16, 24, 32:
+		default:
+			return nil, errors.New("SESSION_BLOCK_KEY must be 16, 24 or 32 bytes long.")
+		}
+	case "redis":
+		if len(config.RedisURL) == 0 && settings.appEnv != nil {
+			config.RedisURL, err = redisURLFromVCAP(settings.appEnv)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(config.RedisURL) == 0 {
+			return nil, errors.New("Redis sessions require SESSION_REDIS_URL or a bound service tagged 'redis'.")
+		}
+	default:
+		return nil, invalidSetting(settings, "SESSION_PROVIDER", config.Provider, "memory, file, cookie or redis")
+	}
+	config.Provider = strings.ToLower(config.Provider)
+	return config, nil
+}
+
+// newSessionManager builds the session manager for the configured provider.
+func newSessionManager(config *sessionConfig) (*session.Manager, error) {
+	providerConfig := ""
+	switch config.Provider {
+	case "file":
+		providerConfig = config.FilePath
+	case "cookie":
+		pc, err := json.Marshal(&cookieProviderConfig{
+			SecurityKey:  config.HashKey,
+			BlockKey:     config.BlockKey,
+			SecurityName: "oauthauthcode",
+			CookieName:   sessionCookieName,
+			Secure:       config.Secure,
+			Maxage:       int(config.Lifetime),
+		})
+		if err != nil {
+			return nil, err
+		}
+		providerConfig = string(pc)
+	case "redis":
+		providerConfig = config.RedisURL
+	}
+
+	mc, err := json.Marshal(&managerConfig{
+		CookieName:     sessionCookieName,
+		Gclifetime:     config.Lifetime,
+		Maxlifetime:    config.Lifetime,
+		Secure:         config.Secure,
+		ProviderConfig: providerConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session.NewManager(config.Provider, string(mc))
+}
+
+func redisURLFromVCAP(appEnv *cfenv.App) (string, error) {
+	services, err := appEnv.Services.WithTag("redis")
+	if err != nil || len(services) == 0 {
+		return "", nil
+	}
+	creds := services[0].Credentials
+
+	if uri, ok := creds["uri"].(string); ok && len(uri) > 0 {
+		return uri, nil
+	}
+	host, _ := creds["host"].(string)
+	if len(host) == 0 {
+		host, _ = creds["hostname"].(string)
+	}
+	if len(host) == 0 {
+		return "", fmt.Errorf("Redis service %s has no host in its credentials", services[0].Name)
+	}
+	port := "6379"
+	switch p := creds["port"].(type) {
+	case string:
+		port = p
+	case float64:
+		port = strconv.Itoa(int(p))
+	}
+	u := &url.URL{Scheme: "redis", Host: host + ":" + port}
+	if password, ok := creds["password"].(string); ok && len(password) > 0 {
+		u.User = url.UserPassword("", password)
+	}
+	return u.String(), nil
+}
+
+// sessionKey holds the request's session store in the request context.
+const sessionKey contextKey = 1
+
+// startSession returns the request's session store, starting it on first use.
+// Middleware and handlers share the one store, so a token refreshed early in
+// the chain is the one later handlers read and write back.
+func startSession(sessionManager *session.Manager, w http.ResponseWriter, r *http.Request) (session.Store, error) {
+	if sess, ok := context.Get(r, sessionKey).(session.Store); ok {
+		return sess, nil
+	}
+	sess, err := sessionManager.SessionStart(w, r)
+	if err != nil {
+		return nil, err
+	}
+	context.Set(r, sessionKey, sess)
+	return sess, nil
+}
+
+// destroySession ends the request's session, dropping any session cookie
+// already set on the response.
+func destroySession(sessionManager *session.Manager, w http.ResponseWriter, r *http.Request) {
+	removeSessionCookie(w.Header())
+	context.Delete(r, sessionKey)
+	sessionManager.SessionDestroy(w, r)
+}
+
+// destroySessionID deletes the session sid from the store, e.g. for a session
+// that belongs to another browser.
+func destroySessionID(sessionManager *session.Manager, sid string) {
+	r := &http.Request{Header: make(http.Header)}
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sid})
+	sessionManager.SessionDestroy(&discardResponseWriter{}, r)
+}
+
+// regenerateSession moves sess to a new session id, so an id planted in the
+// browser before login is worthless afterwards. Cookie sessions have no
+// server-side id and are returned unchanged.
+func regenerateSession(sessionManager *session.Manager, w http.ResponseWriter, r *http.Request, sess session.Store) session.Store {
+	if _, ok := sess.(*session.CookieSessionStore); ok {
+		return sess
+	}
+	if regenerated := sessionManager.SessionRegenerateID(w, r); regenerated != nil {
+		context.Set(r, sessionKey, regenerated)
+		return regenerated
+	}
+	return sess
+}
+
+// releaseSession writes sess like SessionRelease, but fails instead of
+// silently losing a cookie session that is too large for the browser. A cookie
+// session replaces the session cookie already set on the response, so the
+// browser gets the store's latest state once.
+func releaseSession(w http.ResponseWriter, sess session.Store) error {
+	if _, ok := sess.(*session.CookieSessionStore); !ok {
+		sess.SessionRelease(w)
+		return nil
+	}
+	captured := &headerWriter{header: make(http.Header)}
+	sess.SessionRelease(captured)
+	for _, cookie := range captured.header["Set-Cookie"] {
+		if len(cookie) > maxCookieSize {
+			return errSessionTooLarge
+		}
+	}
+	removeSessionCookie(w.Header())
+	for _, cookie := range captured.header["Set-Cookie"] {
+		w.Header().Add("Set-Cookie", cookie)
+	}
+	return nil
+}
+
+// removeSessionCookie drops the session cookie from the response headers.
+func removeSessionCookie(h http.Header) {
+	var kept []string
+	for _, cookie := range h["Set-Cookie"] {
+		if !strings.HasPrefix(cookie, sessionCookieName+"=") {
+			kept = append(kept, cookie)
+		}
+	}
+	if len(kept) == 0 {
+		h.Del("Set-Cookie")
+		return
+	}
+	h["Set-Cookie"] = kept
+}
+
+// headerWriter collects the headers a session writes.
+type headerWriter struct {
+	header http.Header
+}
+
+func (hw *headerWriter) Header() http.Header         { return hw.header }
+func (hw *headerWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (hw *headerWriter) WriteHeader(int)             {}
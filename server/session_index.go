@@ -0,0 +1,322 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/session"
+	"golang.org/x/net/context"
+)
+
+// userIdentityClaims are the profile claims a user can be looked up by.
+var userIdentityClaims = []string{"sub", "user_name", "email"}
+
+const (
+	redisIndexPrefix   = "user_sessions:"
+	indexPruneInterval = time.Minute
+)
+
+var errSessionIndexUnsupported = errors.New("sessions of a user cannot be listed with cookie sessions")
+
+// sessionIndex maps user identifiers to the ids of their sessions, so an
+// administrator can end every session of a user. Sessions are indexed under
+// every identity claim found in the profile.
+type sessionIndex interface {
+	// add records a new session, touch notes that it is still in use
+	add(sid string, profile map[string]interface{})
+	touch(sid string, profile map[string]interface{})
+	remove(sid string, profile map[string]interface{})
+	sessions(user string) ([]string, error)
+	// shared reports whether every instance sees the same index
+	shared() bool
+}
+
+// newSessionIndex picks the index that fits the session store. Redis
+// sessions keep the index in redis; memory and file sessions can only see
+// their own instance; cookie sessions live in the browser and cannot be
+// listed at all.
+func newSessionIndex(config *sessionConfig) sessionIndex {
+	lifetime := time.Duration(config.Lifetime) * time.Second
+	switch config.Provider {
+	case "redis":
+		return &redisSessionIndex{pool: redisProvider.pool, lifetime: lifetime, touched: make(map[string]time.Time)}
+	case "cookie":
+		return noSessionIndex{}
+	}
+	return newMemorySessionIndex(lifetime)
+}
+
+// profileUsers returns the identity claims of profile.
+func profileUsers(profile map[string]interface{}) []string {
+	var users []string
+	for _, claim := range userIdentityClaims {
+		if user, ok := profile[claim].(string); ok && len(user) > 0 {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// memorySessionIndex is a process-local index. Sessions not used for longer
+// than the session lifetime have expired and are pruned.
+type memorySessionIndex struct {
+	lock     sync.Mutex
+	lifetime time.Duration
+	users    map[string]map[string]time.Time
+	pruned   time.Time
+}
+
+func newMemorySessionIndex(lifetime time.Duration) *memorySessionIndex {
+	return &memorySessionIndex{lifetime: lifetime, users: make(map[string]map[string]time.Time)}
+}
+
+func (si *memorySessionIndex) add(sid string, profile map[string]interface{}) {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	now := time.Now()
+	for _, user := range profileUsers(profile) {
+		if si.users[user] == nil {
+			si.users[user] = make(map[string]time.Time)
+		}
+		si.users[user][sid] = now
+	}
+	if now.Sub(si.pruned) >= indexPruneInterval {
+		si.prune(now)
+	}
+}
+
+func (si *memorySessionIndex) touch(sid string, profile map[string]interface{}) {
+	si.add(sid, profile)
+}
+
+// prune drops expired sessions; the caller holds the lock.
+func (si *memorySessionIndex) prune(now time.Time) {
+	for user, sids := range si.users {
+		for sid, seen := range sids {
+			if now.Sub(seen) > si.lifetime {
+				delete(sids, sid)
+			}
+		}
+		if len(sids) == 0 {
+			delete(si.users, user)
+		}
+	}
+	si.pruned = now
+}
+
+func (si *memorySessionIndex) remove(sid string, profile map[string]interface{}) {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	for user, sids := range si.users {
+		delete(sids, sid)
+		if len(sids) == 0 {
+			delete(si.users, user)
+		}
+	}
+}
+
+func (si *memorySessionIndex) sessions(user string) ([]string, error) {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	si.prune(time.Now())
+	var sids []string
+	for sid := range si.users[user] {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+	return sids, nil
+}
+
+func (si *memorySessionIndex) shared() bool { return false }
+
+// redisSessionIndex keeps a set of session ids per user next to the sessions
+// in redis. Each set expires with the last session added or touched in it,
+// and ids whose session has expired are dropped when the set is read.
+type redisSessionIndex struct {
+	pool     *redisPool
+	lifetime time.Duration
+	lock     sync.Mutex
+	touched  map[string]time.Time
+}
+
+func (si *redisSessionIndex) key(user string) string {
+	return redisIndexPrefix + user
+}
+
+func (si *redisSessionIndex) add(sid string, profile map[string]interface{}) {
+	seconds := strconv.FormatInt(int64(si.lifetime/time.Second), 10)
+	for _, user := range profileUsers(profile) {
+		if _, err := si.pool.do("SADD", si.key(user), sid); err != nil {
+			fmt.Printf("Error indexing session %s: %s\n", sid, err)
+			return
+		}
+		si.pool.do("EXPIRE", si.key(user), seconds)
+	}
+	si.lock.Lock()
+	si.touched[sid] = time.Now()
+	si.lock.Unlock()
+}
+
+// touch extends the index entries of a session in use, at most a few times
+// per session lifetime.
+func (si *redisSessionIndex) touch(sid string, profile map[string]interface{}) {
+	now := time.Now()
+	si.lock.Lock()
+	last, ok := si.touched[sid]
+	if ok && now.Sub(last) < si.lifetime/4 {
+		si.lock.Unlock()
+		return
+	}
+	for id, t := range si.touched {
+		if now.Sub(t) > si.lifetime {
+			delete(si.touched, id)
+		}
+	}
+	si.lock.Unlock()
+	si.add(sid, profile)
+}
+
+func (si *redisSessionIndex) remove(sid string, profile map[string]interface{}) {
+	for _, user := range profileUsers(profile) {
+		si.pool.do("SREM", si.key(user), sid)
+	}
+	si.lock.Lock()
+	delete(si.touched, sid)
+	si.lock.Unlock()
+}
+
+func (si *redisSessionIndex) sessions(user string) ([]string, error) {
+	reply, err := si.pool.do("SMEMBERS", si.key(user))
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+	var sids []string
+	for _, m := range members {
+		sid := string(m.([]byte))
+		if redisProvider.SessionExist(sid) {
+			sids = append(sids, sid)
+		} else {
+			si.pool.do("SREM", si.key(user), sid)
+		}
+	}
+	sort.Strings(sids)
+	return sids, nil
+}
+
+func (si *redisSessionIndex) shared() bool { return true }
+
+// noSessionIndex is used with cookie sessions, which the server cannot list
+// or end.
+type noSessionIndex struct{}
+
+func (noSessionIndex) add(sid string, profile map[string]interface{})    {}
+func (noSessionIndex) touch(sid string, profile map[string]interface{})  {}
+func (noSessionIndex) remove(sid string, profile map[string]interface{}) {}
+func (noSessionIndex) shared() bool                                      { return false }
+
+func (noSessionIndex) sessions(user string) ([]string, error) {
+	return nil, errSessionIndexUnsupported
+}
+
+// discardResponseWriter lets sessions be released outside of a request.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	if d.header == nil {
+		d.header = make(http.Header)
+	}
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func (d *discardResponseWriter) WriteHeader(int) {}
+
+// revokeUserSessions revokes the tokens of every session user holds and
+// empties those sessions. It returns the number of sessions ended and the
+// first error. ctx bounds the time spent on revocation retries.
+func revokeUserSessions(ctx context.Context, sessionManager *session.Manager, config *authConfig, user string) (int, error) {
+	sids, err := config.SessionIndex.sessions(user)
+	if err != nil {
+		return 0, err
+	}
+	var firstErr error
+	ended := 0
+	for _, sid := range sids {
+		store, err := sessionManager.GetSessionStore(sid)
+		if err != nil {
+			fmt.Printf("Error loading session %s: %s\n", sid, err)
+			continue
+		}
+		provider := config.forSession(store)
+		profile, _ := store.Get("profile").(map[string]interface{})
+		if jsonToken, ok := store.Get("token").(string); ok {
+			if err := revokeSessionTokens(ctx, provider, jsonToken); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		provider.Exchange.forgetSessionUser(store)
+		destroySessionID(sessionManager, sid)
+		config.SessionIndex.remove(sid, profile)
+		ended++
+	}
+	fmt.Printf("Revoked %d sessions for user %s\n", ended, user)
+	return ended, firstErr
+}
+
+// revokeUserHandler is the admin action that ends all sessions of a user.
+func revokeUserHandler(sessionManager *session.Manager, config *authConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if crossOrigin(r) {
+			http.Error(w, "Cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		user := r.PostFormValue("user")
+		if len(user) == 0 {
+			http.Error(w, "Missing user", http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := requestContext(w, revocationTimeout)
+		defer cancel()
+		ended, err := revokeUserSessions(ctx, sessionManager, config, user)
+		if err == errSessionIndexUnsupported {
+			errorPage(w, http.StatusNotImplemented, "Not Supported", "Sessions cannot be ended from the server when SESSION_PROVIDER is cookie.")
+			return
+		}
+		message := fmt.Sprintf("Ended %d sessions for %s.", ended, user)
+		if !config.SessionIndex.shared() {
+			message = fmt.Sprintf("Ended %d sessions for %s on this instance; sessions on other instances are not affected.", ended, user)
+		}
+		if err != nil {
+			message += " Some tokens could not be revoked at the provider: " + err.Error()
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `
+<html>
+  <head>
+    <title>Sessions Revoked</title>
+  </head>
+  <body>
+    <h2>Sessions Revoked</h2>
+    <p>%s</p>
+    <hr/>
+    <p>Return to the <a href="/protected/admin">Admin Page</a>.</p>
+  </body>
+</html>`, html.EscapeString(message))
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func TestMemorySessionIndex(t *testing.T) {
+	si := newMemorySessionIndex(time.Hour)
+	alice := map[string]interface{}{"sub": "u-1", "email": "alice@example.com"}
+	si.add("s1", alice)
+	si.add("s2", alice)
+	si.add("s3", map[string]interface{}{"sub": "u-2"})
+
+	if sids, _ := si.sessions("alice@example.com"); !reflect.DeepEqual(sids, []string{"s1", "s2"}) {
+		t.Fatalf("sessions by email = %v", sids)
+	}
+	si.remove("s1", alice)
+	if sids, _ := si.sessions("u-1"); !reflect.DeepEqual(sids, []string{"s2"}) {
+		t.Fatalf("sessions after remove = %v", sids)
+	}
+
+	// Sessions unused for longer than the lifetime have expired
+	si.users["u-2"]["s3"] = time.Now().Add(-2 * time.Hour)
+	if sids, _ := si.sessions("u-2"); len(sids) != 0 {
+		t.Fatalf("expired session still listed: %v", sids)
+	}
+	if _, ok := si.users["u-2"]; ok {
+		t.Fatal("expired user entry was not pruned")
+	}
+
+	// Touching keeps a session indexed
+	si.users["u-1"]["s2"] = time.Now().Add(-50 * time.Minute)
+	si.touch("s2", alice)
+	si.prune(time.Now().Add(20 * time.Minute))
+	if sids, _ := si.sessions("u-1"); len(sids) != 1 {
+		t.Fatalf("touched session was pruned: %v", sids)
+	}
+}
+
+func TestRedisSessionIndex(t *testing.T) {
+	sm := newTestRedisManager(t, 60)
+	si := newSessionIndex(&sessionConfig{Provider: "redis", Lifetime: 60})
+	if !si.shared() {
+		t.Fatal("redis index is not shared")
+	}
+	profile := map[string]interface{}{"sub": "u-1"}
+	for _, sid := range []string{"s1", "s2"} {
+		store, _ := sm.GetSessionStore(sid)
+		store.Set("profile", profile)
+		store.SessionRelease(httptest.NewRecorder())
+		si.add(sid, profile)
+	}
+	// s3 is indexed but its session has already expired
+	si.add("s3", profile)
+
+	if sids, err := si.sessions("u-1"); err != nil || !reflect.DeepEqual(sids, []string{"s1", "s2"}) {
+		t.Fatalf("sessions = %v, %v", sids, err)
+	}
+	si.remove("s1", profile)
+	if sids, _ := si.sessions("u-1"); !reflect.DeepEqual(sids, []string{"s2"}) {
+		t.Fatalf("sessions after remove = %v", sids)
+	}
+	reply, _ := redisProvider.pool.do("SMEMBERS", redisIndexPrefix+"u-1")
+	if members, _ := reply.([]interface{}); len(members) != 1 {
+		t.Fatalf("stale ids left in the index: %v", members)
+	}
+}
+
+func TestRevokeUserSessionsAcrossInstances(t *testing.T) {
+	var revoked []string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revoked = append(revoked, r.PostFormValue("token"))
+	}))
+	defer provider.Close()
+	config := newTestConfig()
+	endpoints := *config.staticEndpoints
+	endpoints.Revocation = provider.URL + "/oauth/token/revoke"
+	config.staticEndpoints = &endpoints
+	config.Exchange = &tokenExchange{}
+	config.Providers = &providerRegistry{list: []*authConfig{config}, byName: map[string]*authConfig{config.Name: config}}
+
+	// Two instances share the redis store and therefore the index
+	sm := newTestRedisManager(t, 60)
+	config.SessionIndex = newSessionIndex(&sessionConfig{Provider: "redis", Lifetime: 60})
+	other := *config
+	other.SessionIndex = newSessionIndex(&sessionConfig{Provider: "redis", Lifetime: 60})
+
+	profile := map[string]interface{}{"sub": "u-1"}
+	store, _ := sm.GetSessionStore("s1")
+	jsonToken, _ := tokenToJSON(&oauth2.Token{AccessToken: "at-1", RefreshToken: "rt-1"})
+	store.Set("token", jsonToken)
+	store.Set("profile", profile)
+	store.SessionRelease(httptest.NewRecorder())
+	other.SessionIndex.add("s1", profile)
+	inFlight, _ := sm.GetSessionStore("s1")
+
+	ended, err := revokeUserSessions(context.Background(), sm, config, "u-1")
+	if err != nil || ended != 1 {
+		t.Fatalf("ended %d sessions, error %v", ended, err)
+	}
+	if !reflect.DeepEqual(revoked, []string{"rt-1", "at-1"}) {
+		t.Fatalf("revoked %v", revoked)
+	}
+
+	// A request that read the session before the revocation cannot write it back
+	inFlight.SessionRelease(httptest.NewRecorder())
+	if redisProvider.SessionExist("s1") {
+		t.Fatal("the revoked session still exists")
+	}
+	store, _ = sm.GetSessionStore("s1")
+	if store.Get("token") != nil {
+		t.Fatal("session still holds a token")
+	}
+}
+
+func TestRevokeUserHandlerWithCookieSessions(t *testing.T) {
+	config := newTestConfig()
+	config.SessionIndex = newSessionIndex(&sessionConfig{Provider: "cookie"})
+	r := httptest.NewRequest("POST", "/protected/admin/revoke", strings.NewReader(url.Values{"user": {"u-1"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	revokeUserHandler(newTestSessionManager(t), config)(w, r)
+	if w.Code != http.StatusNotImplemented {
+		t.Fatalf("status %d, want 501", w.Code)
+	}
+}
+
+func TestRevokeWithRetryStopsWhenContextIsDone(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer provider.Close()
+	config := newTestConfig()
+	endpoints := *config.staticEndpoints
+	endpoints.Revocation = provider.URL
+	config.staticEndpoints = &endpoints
+
+	ctx, cancel := context.WithTimeout(config.context(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := revokeWithRetry(ctx, config, "at-1", "access_token")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("error = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > revocationBackoff {
+		t.Fatalf("retries ran for %s after the context was done", elapsed)
+	}
+}
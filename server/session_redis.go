@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/session"
+)
+
+const (
+	redisSessionPrefix = "session:"
+	redisPoolSize      = 10
+	redisDialTimeout   = 5 * time.Second
+)
+
+var redisProvider = &redisSessionProvider{}
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisPool is a minimal RESP client holding a small pool of connections.
+type redisPool struct {
+	addr     string
+	password string
+	db       int
+	conns    chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedisPool(rawurl string) (*redisPool, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("Unsupported redis url scheme %q", u.Scheme)
+	}
+	p := &redisPool{
+		addr:  u.Host,
+		conns: make(chan *redisConn, redisPoolSize),
+	}
+	if !strings.Contains(p.addr, ":") {
+		p.addr += ":6379"
+	}
+	if u.User != nil {
+		p.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); len(db) > 0 {
+		if p.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("Invalid redis database %q", db)
+		}
+	}
+	return p, nil
+}
+
+func (p *redisPool) get() (*redisConn, error) {
+	select {
+	case c := <-p.conns:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", p.addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+	if len(p.password) > 0 {
+		if _, err := c.do("AUTH", p.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if p.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(p.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (p *redisPool) put(c *redisConn) {
+	select {
+	case p.conns <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// do runs a single command on a pooled connection. Connections that fail
+// with anything other than a server error reply are discarded.
+func (p *redisPool) do(args ...string) (interface{}, error) {
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		return nil, err
+	}
+	p.put(c)
+	return reply, err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisDialTimeout))
+	if err := writeRedisCommand(c.conn, args); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.rd)
+}
+
+func writeRedisCommand(w io.Writer, args []string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRedisReply decodes one RESP value: strings and bulk strings become
+// []byte, integers int64, arrays []interface{} and nil bulk strings nil.
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return []byte(body), nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readRedisReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+}
+
+// redisSessionStore holds the values of one session until they are written
+// back to redis on SessionRelease.
+type redisSessionStore struct {
+	provider *redisSessionProvider
+	sid      string
+	existed  bool
+	lock     sync.RWMutex
+	values   map[interface{}]interface{}
+}
+
+func (rs *redisSessionStore) Set(key, value interface{}) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.values[key] = value
+	return nil
+}
+
+func (rs *redisSessionStore) Get(key interface{}) interface{} {
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	return rs.values[key]
+}
+
+func (rs *redisSessionStore) Delete(key interface{}) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	delete(rs.values, key)
+	return nil
+}
+
+func (rs *redisSessionStore) Flush() error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.values = make(map[interface{}]interface{})
+	return nil
+}
+
+func (rs *redisSessionStore) SessionID() string {
+	return rs.sid
+}
+
+// SessionRelease writes the whole session back with SETEX. Writes are last
+// write wins: when two requests of the same session overlap, the later
+// release overwrites the other's changes, including a consumed login attempt.
+// A session that existed when it was read is only written while it still
+// exists, so a request in flight cannot bring back a destroyed session.
+func (rs *redisSessionStore) SessionRelease(w http.ResponseWriter) {
+	rs.lock.RLock()
+	b, err := session.EncodeGob(rs.values)
+	rs.lock.RUnlock()
+	if err != nil {
+		fmt.Printf("Error encoding session %s: %s\n", rs.sid, err)
+		return
+	}
+	ttl := strconv.FormatInt(rs.provider.maxlifetime, 10)
+	if rs.existed {
+		_, err = rs.provider.pool.do("SET", rs.provider.key(rs.sid), string(b), "EX", ttl, "XX")
+	} else {
+		_, err = rs.provider.pool.do("SETEX", rs.provider.key(rs.sid), ttl, string(b))
+	}
+	if err != nil {
+		fmt.Printf("Error saving session %s: %s\n", rs.sid, err)
+	}
+}
+
+// redisSessionProvider stores gob-encoded sessions in redis and lets redis
+// expire them, so every instance of the app sees the same sessions.
+type redisSessionProvider struct {
+	maxlifetime int64
+	pool        *redisPool
+}
+
+// SessionInit expects config to be a redis url, e.g. redis://:password@host:6379/0
+func (rp *redisSessionProvider) SessionInit(maxlifetime int64, config string) (err error) {
+	rp.maxlifetime = maxlifetime
+	rp.pool, err = newRedisPool(config)
+	if err != nil {
+		return err
+	}
+	_, err = rp.pool.do("PING")
+	return err
+}
+
+func (rp *redisSessionProvider) SessionRead(sid string) (session.Store, error) {
+	reply, err := rp.pool.do("GET", rp.key(sid))
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{})
+	b, existed := reply.([]byte)
+	if existed && len(b) > 0 {
+		if values, err = session.DecodeGob(b); err != nil {
+			return nil, err
+		}
+	}
+	return &redisSessionStore{provider: rp, sid: sid, existed: existed, values: values}, nil
+}
+
+func (rp *redisSessionProvider) SessionExist(sid string) bool {
+	reply, err := rp.pool.do("EXISTS", rp.key(sid))
+	if err != nil {
+		fmt.Printf("Error checking session %s: %s\n", sid, err)
+		return false
+	}
+	n, _ := reply.(int64)
+	return n > 0
+}
+
+func (rp *redisSessionProvider) SessionRegenerate(oldsid, sid string) (session.Store, error) {
+	if rp.SessionExist(oldsid) {
+		if _, err := rp.pool.do("RENAME", rp.key(oldsid), rp.key(sid)); err != nil {
+			return nil, err
+		}
+		if _, err := rp.pool.do("EXPIRE", rp.key(sid), strconv.FormatInt(rp.maxlifetime, 10)); err != nil {
+			return nil, err
+		}
+	}
+	return rp.SessionRead(sid)
+}
+
+func (rp *redisSessionProvider) SessionDestroy(sid string) error {
+	_, err := rp.pool.do("DEL", rp.key(sid))
+	return err
+}
+
+// SessionGC is a no-op; redis expires session keys on its own.
+func (rp *redisSessionProvider) SessionGC() {}
+
+// SessionAll is not tracked for redis sessions and always returns 0.
+func (rp *redisSessionProvider) SessionAll() int {
+	return 0
+}
+
+func (rp *redisSessionProvider) key(sid string) string {
+	return redisSessionPrefix + sid
+}
+
+func init() {
+	session.Register("redis", redisProvider)
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/session"
+)
+
+func newTestRedisManager(t *testing.T, lifetime int64) *session.Manager {
+	addr, err := startFakeRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm, err := newSessionManager(&sessionConfig{
+		Provider: "redis",
+		Lifetime: lifetime,
+		RedisURL: "redis://" + addr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sm
+}
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  interface{}
+		err   string
+	}{
+		{"simple string", "+OK\r\n", []byte("OK"), ""},
+		{"error", "-ERR wrong type\r\n", nil, "ERR wrong type"},
+		{"integer", ":42\r\n", int64(42), ""},
+		{"bulk string", "$5\r\nhello\r\n", []byte("hello"), ""},
+		{"binary bulk string", "$4\r\na\r\nb\r\n", []byte("a\r\nb"), ""},
+		{"empty bulk string", "$0\r\n\r\n", []byte{}, ""},
+		{"nil bulk string", "$-1\r\n", nil, ""},
+		{"array", "*2\r\n$3\r\nGET\r\n:1\r\n", []interface{}{[]byte("GET"), int64(1)}, ""},
+		{"nil array", "*-1\r\n", nil, ""},
+		{"missing crlf", "+OK\n", nil, "malformed"},
+		{"unknown type", "?x\r\n", nil, "unexpected reply type"},
+		{"short bulk string", "$10\r\nabc\r\n", nil, "EOF"},
+	}
+	for _, tt := range tests {
+		got, err := readRedisReply(bufio.NewReader(strings.NewReader(tt.input)))
+		if len(tt.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadRedisReplyErrorType(t *testing.T) {
+	_, err := readRedisReply(bufio.NewReader(strings.NewReader("-NOAUTH required\r\n")))
+	if _, ok := err.(redisError); !ok {
+		t.Fatalf("error reply returned %T, want redisError", err)
+	}
+}
+
+func TestWriteRedisCommand(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeRedisCommand(&buf, []string{"SET", "k", "a b"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$3\r\na b\r\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestRedisPoolCommands(t *testing.T) {
+	addr, err := startFakeRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := newRedisPool("redis://:secret@" + addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pool.do("SET", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := pool.do("GET", "k"); err != nil || string(reply.([]byte)) != "v" {
+		t.Fatalf("GET k = %v, %v", reply, err)
+	}
+	if reply, err := pool.do("GET", "missing"); err != nil || reply != nil {
+		t.Fatalf("GET missing = %v, %v; want nil reply", reply, err)
+	}
+	if _, err := pool.do("NOSUCH"); err == nil {
+		t.Fatal("unknown command did not return an error reply")
+	}
+	// The connection survives a server error reply
+	if reply, err := pool.do("EXISTS", "k"); err != nil || reply.(int64) != 1 {
+		t.Fatalf("EXISTS k = %v, %v", reply, err)
+	}
+	if reply, err := pool.do("DEL", "k"); err != nil || reply.(int64) != 1 {
+		t.Fatalf("DEL k = %v, %v", reply, err)
+	}
+}
+
+func TestNewRedisPoolURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		password string
+		db       int
+		ok       bool
+	}{
+		{"redis://localhost", "localhost:6379", "", 0, true},
+		{"redis://:pw@cache:6380/3", "cache:6380", "pw", 3, true},
+		{"http://localhost", "", "", 0, false},
+		{"redis://localhost/x", "", "", 0, false},
+	}
+	for _, tt := range tests {
+		p, err := newRedisPool(tt.url)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if p.addr != tt.addr || p.password != tt.password || p.db != tt.db {
+			t.Errorf("%s: got %s %q %d", tt.url, p.addr, p.password, p.db)
+		}
+	}
+}
+
+func TestRedisSessionRoundTrip(t *testing.T) {
+	sm := newTestRedisManager(t, 60)
+
+	// Start a session and store values in it
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	sess, err := sm.SessionStart(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Set("token", `{"access_token":"abc"}`)
+	sess.Set("profile", map[string]interface{}{"sub": "user-1"})
+	sess.SessionRelease(w)
+	cookie := sessionCookie(t, w)
+
+	// A later request with the cookie sees the same values
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	sess, err = sm.SessionStart(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.SessionID() != cookie.Value {
+		t.Fatalf("session id %s, want %s", sess.SessionID(), cookie.Value)
+	}
+	if got := sess.Get("token"); got != `{"access_token":"abc"}` {
+		t.Fatalf("token = %v", got)
+	}
+	if profile, _ := sess.Get("profile").(map[string]interface{}); profile["sub"] != "user-1" {
+		t.Fatalf("profile = %v", sess.Get("profile"))
+	}
+
+	// Deleting a key is persisted on release
+	sess.Delete("token")
+	sess.SessionRelease(httptest.NewRecorder())
+	store, err := sm.GetSessionStore(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Get("token") != nil {
+		t.Fatal("deleted key is still in the session")
+	}
+
+	// Destroying the session removes it from redis
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	sm.SessionDestroy(w, r)
+	if redisProvider.SessionExist(cookie.Value) {
+		t.Fatal("destroyed session still exists")
+	}
+	store, err = sm.GetSessionStore(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Get("profile") != nil {
+		t.Fatal("destroyed session still has values")
+	}
+}
+
+func TestRedisSessionExpires(t *testing.T) {
+	sm := newTestRedisManager(t, 1)
+
+	store, err := sm.GetSessionStore("expiring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("token", "abc")
+	store.SessionRelease(httptest.NewRecorder())
+	if !redisProvider.SessionExist("expiring") {
+		t.Fatal("session was not saved")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if redisProvider.SessionExist("expiring") {
+		t.Fatal("session outlived its lifetime")
+	}
+	store, err = sm.GetSessionStore("expiring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Get("token") != nil {
+		t.Fatal("expired session still has values")
+	}
+}
+
+func TestRedisSessionRegenerate(t *testing.T) {
+	sm := newTestRedisManager(t, 60)
+
+	store, err := sm.GetSessionStore("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("profile", "user-1")
+	store.SessionRelease(httptest.NewRecorder())
+
+	store, err = redisProvider.SessionRegenerate("old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.SessionID() != "new" || store.Get("profile") != "user-1" {
+		t.Fatalf("regenerated session %s has %v", store.SessionID(), store.Get("profile"))
+	}
+	if redisProvider.SessionExist("old") {
+		t.Fatal("old session id still exists")
+	}
+}
+
+// sessionCookie returns the session cookie set on w.
+func sessionCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	// Browsers keep the last of several cookies with the same name
+	var found *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			found = c
+		}
+	}
+	if found == nil {
+		t.Fatal("no session cookie set")
+	}
+	return found
+}
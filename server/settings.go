@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+)
+
+// settingSource is one layer of configuration values, keyed by setting name
+// (the environment variable name, e.g. AUTH_CALLBACK).
+type settingSource struct {
+	Name   string
+	lookup func(key string) (string, bool)
+}
+
+// Settings resolves configuration values from layered sources. Later sources
+// override earlier ones: defaults, the config file, the environment, the
+// sso service binding and finally command line flags. NewServer hands them to
+// every *FromEnv function; there is no package-wide copy.
+type Settings struct {
+	sources []*settingSource
+	appEnv  *cfenv.App
+}
+
+// settingDefaults are the values used when no source sets a setting.
+var settingDefaults = map[string]string{
+	"PORT":             "3000",
+	"SSO_DISPLAY_NAME": "Single Sign-On",
+}
+
+// LoadSettings layers the configuration sources. The JSON config file is named
+// by the -config flag or CONFIG_FILE; -set KEY=VALUE flags override everything
+// else. appEnv may be nil outside Cloud Foundry.
+func LoadSettings(appEnv *cfenv.App, args []string) (*Settings, error) {
+	flags := flag.NewFlagSet("oauth-authcode", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "JSON configuration file")
+	port := flags.String("port", "", "port to listen on")
+	overrides := settingFlags{}
+	flags.Var(overrides, "set", "KEY=VALUE setting, may be repeated")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected arguments %v", flags.Args())
+	}
+	if len(*port) > 0 {
+		overrides["PORT"] = *port
+	}
+
+	s := &Settings{appEnv: appEnv}
+	s.sources = append(s.sources, mapSource("defaults", settingDefaults))
+	if len(*configFile) > 0 {
+		values, err := settingsFromFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		s.sources = append(s.sources, mapSource("config file "+*configFile, values))
+	}
+	s.sources = append(s.sources, envSource())
+	if appEnv != nil {
+		s.sources = append(s.sources, mapSource("sso service binding", ssoBindingSettings(appEnv)))
+	}
+	s.sources = append(s.sources, mapSource("command line", overrides))
+	return s, nil
+}
+
+// Lookup returns the value of key from the highest layer that sets it.
+func (s *Settings) Lookup(key string) (string, bool) {
+	v, _, ok := s.find(key)
+	return v, ok
+}
+
+// Get returns the value of key, or "" when it is unset.
+func (s *Settings) Get(key string) string {
+	v, _ := s.Lookup(key)
+	return v
+}
+
+// Source names the layer that key was read from, for error messages.
+func (s *Settings) Source(key string) string {
+	_, source, ok := s.find(key)
+	if !ok {
+		return "unset"
+	}
+	return source
+}
+
+func (s *Settings) find(key string) (string, string, bool) {
+	for i := len(s.sources) - 1; i >= 0; i-- {
+		if v, ok := s.sources[i].lookup(key); ok {
+			return v, s.sources[i].Name, true
+		}
+	}
+	return "", "", false
+}
+
+// Bool returns key parsed as true or false, or def when key is unset.
+func (s *Settings) Bool(key string, def bool) (bool, error) {
+	v := s.Get(key)
+	if len(v) == 0 {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, invalidSetting(s, key, v, "true or false")
+	}
+	return b, nil
+}
+
+// Duration returns key parsed as a duration such as 30s, or def when key is
+// unset. Negative durations are invalid.
+func (s *Settings) Duration(key string, def time.Duration) (time.Duration, error) {
+	v := s.Get(key)
+	if len(v) == 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return def, invalidSetting(s, key, v, "a duration such as 30s")
+	}
+	return d, nil
+}
+
+// positiveDuration is Duration for settings where zero makes no sense.
+func positiveDuration(s *Settings, key string, def time.Duration) (time.Duration, error) {
+	d, err := s.Duration(key, def)
+	if err == nil && d == 0 {
+		return def, invalidSetting(s, key, s.Get(key), "a positive duration such as 30s")
+	}
+	return d, err
+}
+
+// Describe lists the sources in the order they are applied.
+func (s *Settings) Describe() string {
+	var names []string
+	for _, source := range s.sources {
+		names = append(names, source.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func mapSource(name string, values map[string]string) *settingSource {
+	return &settingSource{Name: name, lookup: func(key string) (string, bool) {
+		v, ok := values[key]
+		return v, ok
+	}}
+}
+
+// envSource reads the process environment; empty variables count as unset.
+func envSource() *settingSource {
+	return &settingSource{Name: "environment", lookup: func(key string) (string, bool) {
+		v := os.Getenv(key)
+		return v, len(v) > 0
+	}}
+}
+
+// ssoBindingSettings exposes the credentials of the service named sso as
+// SSO_<CREDENTIAL> settings, e.g. SSO_CLIENT_ID.
+func ssoBindingSettings(appEnv *cfenv.App) map[string]string {
+	values := make(map[string]string)
+	service, err := appEnv.Services.WithName("sso")
+	if err != nil {
+		return values
+	}
+	for k, v := range service.Credentials {
+		if s, ok := v.(string); ok {
+			values["SSO_"+settingName(k)] = s
+		}
+	}
+	return values
+}
+
+// settingFlags collects repeated -set KEY=VALUE flags.
+type settingFlags map[string]string
+
+func (sf settingFlags) String() string {
+	var pairs []string
+	for k, v := range sf {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func (sf settingFlags) Set(pair string) error {
+	i := strings.Index(pair, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected KEY=VALUE, got %q", pair)
+	}
+	sf[settingName(pair[:i])] = pair[i+1:]
+	return nil
+}
+
+// settingName normalizes a config file key or flag name to the environment
+// variable spelling: "logout.revoke-tokens" becomes LOGOUT_REVOKE_TOKENS.
+func settingName(key string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+}
+
+// settingsFromFile reads a JSON config file. Nested sections are joined with
+// underscores, so {"sso": {"client_id": "x"}} sets SSO_CLIENT_ID. Lists of
+// plain values become comma separated; other lists stay JSON.
+func settingsFromFile(file string) (map[string]string, error) {
+	if !strings.EqualFold(filepath.Ext(file), ".json") {
+		return nil, fmt.Errorf("Config file %s must be JSON and end in .json", file)
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read config file: %s", err)
+	}
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err = decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("Could not parse config file %s: %s", file, err)
+	}
+
+	values := make(map[string]string)
+	flattenSettings("", doc, values)
+	return values, nil
+}
+
+func flattenSettings(prefix string, v interface{}, values map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			key := settingName(k)
+			if len(prefix) > 0 {
+				key = prefix + "_" + key
+			}
+			flattenSettings(key, child, values)
+		}
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				raw, _ := json.Marshal(v)
+				values[prefix] = string(raw)
+				return
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		values[prefix] = strings.Join(items, ",")
+	case nil:
+		values[prefix] = ""
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+)
+
+// newTestSettings returns settings holding values over the defaults.
+func newTestSettings(values map[string]string) *Settings {
+	return &Settings{sources: []*settingSource{mapSource("defaults", settingDefaults), mapSource("test", values)}}
+}
+
+func writeTestFile(t *testing.T, name string, content string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadSettingsPrecedence(t *testing.T) {
+	file := writeTestFile(t, "config.json", `{
+	"sso": {"display_name": "From File", "client_id": "file-client"},
+	"settings_test": {"file": "file", "env": "file"},
+	"port": 4000
+}`)
+	t.Setenv("SETTINGS_TEST_ENV", "env")
+	t.Setenv("SSO_CLIENT_ID", "env-client")
+	t.Setenv("PORT", "5000")
+	appEnv := &cfenv.App{Services: cfenv.Services{"p-identity": {{
+		Name:        "sso",
+		Credentials: map[string]interface{}{"client_id": "vcap-client", "auth_domain": "https://login.example.com"},
+	}}}}
+
+	settings, err := LoadSettings(appEnv, []string{"-config", file, "-port", "8080", "-set", "settings-test.flag=flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key    string
+		value  string
+		source string
+	}{
+		{"SSO_DISPLAY_NAME", "From File", "config file " + file},
+		{"SETTINGS_TEST_FILE", "file", "config file " + file},
+		{"SETTINGS_TEST_ENV", "env", "environment"},
+		{"SSO_CLIENT_ID", "vcap-client", "sso service binding"},
+		{"SSO_AUTH_DOMAIN", "https://login.example.com", "sso service binding"},
+		{"PORT", "8080", "command line"},
+		{"SETTINGS_TEST_FLAG", "flag", "command line"},
+		{"SETTINGS_TEST_UNSET", "", "unset"},
+	}
+	for _, tt := range tests {
+		if v := settings.Get(tt.key); v != tt.value {
+			t.Errorf("%s = %q, want %q", tt.key, v, tt.value)
+		}
+		if source := settings.Source(tt.key); source != tt.source {
+			t.Errorf("%s from %q, want %q", tt.key, source, tt.source)
+		}
+	}
+
+	want := "defaults, config file " + file + ", environment, sso service binding, command line"
+	if d := settings.Describe(); d != want {
+		t.Errorf("Describe() = %q", d)
+	}
+
+	// Outside Cloud Foundry there is no binding layer, and defaults apply
+	settings, err = LoadSettings(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Get("SSO_DISPLAY_NAME") != "Single Sign-On" || settings.Get("SSO_CLIENT_ID") != "env-client" {
+		t.Errorf("got %q, %q", settings.Get("SSO_DISPLAY_NAME"), settings.Get("SSO_CLIENT_ID"))
+	}
+}
+
+func TestLoadSettingsErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-set", "NOVALUE"}, "expected KEY=VALUE"},
+		{[]string{"-set", "=value"}, "expected KEY=VALUE"},
+		{[]string{"-unknown"}, "not defined"},
+		{[]string{"extra"}, "Unexpected arguments"},
+		{[]string{"-config", "/nonexistent/config.json"}, "Could not read config file"},
+		{[]string{"-config", writeTestFile(t, "config.ini", "a=b")}, "must be JSON and end in .json"},
+		{[]string{"-config", writeTestFile(t, "config.yaml", "a: b")}, "must be JSON and end in .json"},
+		{[]string{"-config", writeTestFile(t, "config.json", "{")}, "Could not parse config file"},
+		{[]string{"-config", writeTestFile(t, "config.json", "[1]")}, "Could not parse config file"},
+	}
+	for _, tt := range tests {
+		_, err := LoadSettings(nil, tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: error = %v, want %q", tt.args, err, tt.err)
+		}
+	}
+}
+
+func TestSettingsFromFile(t *testing.T) {
+	want := map[string]string{
+		"SSO_CLIENT_ID":          "x",
+		"LOGOUT_REVOKE_TOKENS":   "true",
+		"REDIRECT_ALLOWED_HOSTS": "a.example.com,b.example.com",
+		"HTTP_TIMEOUT":           "10",
+		"BACKING_SERVICES":       `[{"url":"https://b.example.com"}]`,
+		"EMPTY":                  "",
+	}
+	values, err := settingsFromFile(writeTestFile(t, "config.JSON", `{"sso": {"client_id": "x"}, "logout": {"revoke-tokens": true},
+		"redirect": {"allowed_hosts": ["a.example.com", "b.example.com"]}, "http_timeout": 10,
+		"backing_services": [{"url": "https://b.example.com"}], "empty": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, want %v", values, want)
+	}
+}
+
+func TestTypedSettings(t *testing.T) {
+	settings := newTestSettings(map[string]string{
+		"ON":       "true",
+		"OFF":      "0",
+		"MAYBE":    "sometimes",
+		"TIMEOUT":  "90s",
+		"ZERO":     "0s",
+		"NEGATIVE": "-1s",
+		"SECONDS":  "30",
+	})
+	bools := []struct {
+		key  string
+		def  bool
+		want bool
+		err  string
+	}{
+		{"ON", false, true, ""},
+		{"OFF", true, false, ""},
+		{"UNSET", true, true, ""},
+		{"MAYBE", true, true, `MAYBE "sometimes" from test is invalid; expected true or false`},
+	}
+	for _, tt := range bools {
+		got, err := settings.Bool(tt.key, tt.def)
+		if got != tt.want || !matchesError(err, tt.err) {
+			t.Errorf("Bool(%s) = %v, %v; want %v, %q", tt.key, got, err, tt.want, tt.err)
+		}
+	}
+
+	durations := []struct {
+		key      string
+		want     time.Duration
+		err      string
+		positive string
+	}{
+		{"TIMEOUT", 90 * time.Second, "", ""},
+		{"UNSET", time.Minute, "", ""},
+		{"ZERO", 0, "", `ZERO "0s" from test is invalid; expected a positive duration`},
+		{"NEGATIVE", time.Minute, `NEGATIVE "-1s" from test is invalid; expected a duration`, `NEGATIVE "-1s"`},
+		{"SECONDS", time.Minute, `SECONDS "30" from test is invalid`, `SECONDS "30"`},
+	}
+	for _, tt := range durations {
+		got, err := settings.Duration(tt.key, time.Minute)
+		if got != tt.want || !matchesError(err, tt.err) {
+			t.Errorf("Duration(%s) = %v, %v; want %v, %q", tt.key, got, err, tt.want, tt.err)
+		}
+		if _, err = positiveDuration(settings, tt.key, time.Minute); !matchesError(err, tt.positive) {
+			t.Errorf("positiveDuration(%s) error = %v, want %q", tt.key, err, tt.positive)
+		}
+	}
+}
+
+// matchesError reports whether err is nil when want is empty, or mentions want.
+func matchesError(err error, want string) bool {
+	if len(want) == 0 {
+		return err == nil
+	}
+	return err != nil && strings.Contains(err.Error(), want)
+}
+
+func TestInitOAuthConfigReportsEveryError(t *testing.T) {
+	config := initOAuthConfig(newTestSettings(map[string]string{
+		"FETCH_USERINFO": "sometimes",
+		"JWT_LEEWAY":     "-1s",
+		"PKCE_METHOD":    "md5",
+		"HTTP_TIMEOUT":   "soon",
+	}))
+	for _, want := range []string{
+		"SSO_CLIENT_ID is not set",
+		"SSO_AUTH_DOMAIN is not set",
+		"AUTH_CALLBACK is not set",
+		"SSO_CLIENT_SECRET is not set",
+		`FETCH_USERINFO "sometimes" from test is invalid`,
+		`JWT_LEEWAY "-1s" from test is invalid`,
+		`PKCE_METHOD "md5" from test is invalid`,
+		`HTTP_TIMEOUT "soon" from test is invalid`,
+	} {
+		found := false
+		for _, err := range config.Errors {
+			if strings.Contains(err.Error(), want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no error mentions %q in %v", want, config.Errors)
+		}
+	}
+}
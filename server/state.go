@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/astaxie/beego/session"
+)
+
+const (
+	loginAttemptsKey   = "login_attempts"
+	loginAttemptTTL    = 10 * time.Minute
+	maxPendingAttempts = 5
+	maxReturnToLength  = 2048
+)
+
+var (
+	errStateMissing = errors.New("The login response did not include a state parameter.")
+	errStateUnknown = errors.New("The login response does not match a login started from this browser, or it has already been used.")
+	errStateExpired = errors.New("The login attempt has expired.")
+)
+
+// loginAttempt is the per-login data bound to the browser session between
+// the authorize redirect and the callback.
+type loginAttempt struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier,omitempty"`
+	ReturnTo string    `json:"return_to,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+func newLoginAttempt(config *authConfig) (*loginAttempt, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	la := &loginAttempt{State: state, Nonce: nonce, Created: time.Now()}
+	if config.PKCEMethod != pkceOff {
+		if la.Verifier, err = newCodeVerifier(); err != nil {
+			return nil, err
+		}
+	}
+	return la, nil
+}
+
+func (la *loginAttempt) expired() bool {
+	return time.Since(la.Created) > loginAttemptTTL
+}
+
+// randomString returns n bytes from the system CSPRNG, base64url encoded.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// saveLoginAttempt records la in the session. Expired attempts are pruned and
+// only the most recent few are kept, so several tabs may log in at once.
+func saveLoginAttempt(sess session.Store, la *loginAttempt) error {
+	attempts := loginAttemptsFromSession(sess)
+	for state, a := range attempts {
+		if a.expired() {
+			delete(attempts, state)
+		}
+	}
+	for len(attempts) >= maxPendingAttempts {
+		oldest := ""
+		for state, a := range attempts {
+			if len(oldest) == 0 || a.Created.Before(attempts[oldest].Created) {
+				oldest = state
+			}
+		}
+		delete(attempts, oldest)
+	}
+	attempts[la.State] = la
+	return storeLoginAttempts(sess, attempts)
+}
+
+// takeLoginAttempt removes and returns the attempt matching state. Every
+// attempt can be taken only once.
+func takeLoginAttempt(sess session.Store, state string) (*loginAttempt, error) {
+	if len(state) == 0 {
+		return nil, errStateMissing
+	}
+	attempts := loginAttemptsFromSession(sess)
+	la, ok := attempts[state]
+	if !ok {
+		return nil, errStateUnknown
+	}
+	delete(attempts, state)
+	if err := storeLoginAttempts(sess, attempts); err != nil {
+		return nil, err
+	}
+	if la.expired() {
+		return nil, errStateExpired
+	}
+	return la, nil
+}
+
+func loginAttemptsFromSession(sess session.Store) map[string]*loginAttempt {
+	attempts := make(map[string]*loginAttempt)
+	if raw, ok := sess.Get(loginAttemptsKey).(string); ok {
+		json.Unmarshal([]byte(raw), &attempts)
+	}
+	return attempts
+}
+
+func storeLoginAttempts(sess session.Store, attempts map[string]*loginAttempt) error {
+	if len(attempts) == 0 {
+		return sess.Delete(loginAttemptsKey)
+	}
+	d, err := json.Marshal(attempts)
+	if err != nil {
+		return err
+	}
+	return sess.Set(loginAttemptsKey, string(d))
+}
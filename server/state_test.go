@@ -0,0 +1,95 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/session"
+)
+
+// newTestSession returns an empty session from an in-memory store.
+func newTestSession(t *testing.T) session.Store {
+	sess, err := newTestSessionManager(t).GetSessionStore("test-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func TestNewLoginAttempt(t *testing.T) {
+	la, err := newLoginAttempt(&authConfig{PKCEMethod: pkceS256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(la.State) < 43 || len(la.Nonce) < 43 || len(la.Verifier) < 43 {
+		t.Fatalf("attempt values are too short: %+v", la)
+	}
+	other, _ := newLoginAttempt(&authConfig{PKCEMethod: pkceOff})
+	if other.State == la.State || other.Nonce == la.Nonce {
+		t.Fatal("login attempts reuse state or nonce")
+	}
+	if len(other.Verifier) > 0 {
+		t.Fatal("verifier set with PKCE off")
+	}
+}
+
+func TestTakeLoginAttempt(t *testing.T) {
+	sess := newTestSession(t)
+	la := &loginAttempt{State: "state-1", Nonce: "nonce-1", Created: time.Now()}
+	if err := saveLoginAttempt(sess, la); err != nil {
+		t.Fatal(err)
+	}
+	expired := &loginAttempt{State: "state-old", Created: time.Now().Add(-loginAttemptTTL - time.Minute)}
+	attempts := loginAttemptsFromSession(sess)
+	attempts[expired.State] = expired
+	storeLoginAttempts(sess, attempts)
+
+	tests := []struct {
+		name  string
+		state string
+		err   error
+	}{
+		{"missing state", "", errStateMissing},
+		{"unknown state", "forged", errStateUnknown},
+		{"expired attempt", "state-old", errStateExpired},
+		{"expired attempt replayed", "state-old", errStateUnknown},
+		{"valid state", "state-1", nil},
+		{"replayed state", "state-1", errStateUnknown},
+	}
+	for _, tt := range tests {
+		got, err := takeLoginAttempt(sess, tt.state)
+		if err != tt.err {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && got.Nonce != "nonce-1" {
+			t.Errorf("%s: got attempt %+v", tt.name, got)
+		}
+	}
+	if sess.Get(loginAttemptsKey) != nil {
+		t.Error("consumed attempts were left in the session")
+	}
+}
+
+func TestSaveLoginAttemptKeepsRecentAttempts(t *testing.T) {
+	sess := newTestSession(t)
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < maxPendingAttempts+2; i++ {
+		la := &loginAttempt{State: string(rune('a' + i)), Created: start.Add(time.Duration(i) * time.Second)}
+		if err := saveLoginAttempt(sess, la); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attempts := loginAttemptsFromSession(sess)
+	if len(attempts) != maxPendingAttempts {
+		t.Fatalf("kept %d attempts, want %d", len(attempts), maxPendingAttempts)
+	}
+	for _, state := range []string{"a", "b"} {
+		if _, ok := attempts[state]; ok {
+			t.Errorf("oldest attempt %q was not dropped", state)
+		}
+	}
+	if _, err := takeLoginAttempt(sess, "g"); err != nil {
+		t.Errorf("newest attempt: %v", err)
+	}
+}
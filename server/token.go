@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// tokenError is an error response from the token endpoint (RFC 6749 section 5.2).
+type tokenError struct {
+	Status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *tokenError) Error() string {
+	if len(e.Description) > 0 {
+		return fmt.Sprintf("token endpoint returned %s: %s", e.Code, e.Description)
+	}
+	return fmt.Sprintf("token endpoint returned %s (HTTP %d)", e.Code, e.Status)
+}
+
+// tokenResponse is the successful token endpoint response.
+type tokenResponse struct {
+	AccessToken  string      `json:"access_token"`
+	TokenType    string      `json:"token_type"`
+	RefreshToken string      `json:"refresh_token"`
+	ExpiresIn    json.Number `json:"expires_in"`
+}
+
+// retrieveToken posts v to the token endpoint using the HTTP client found in
+// ctx. The full response is kept as the token's extra data, so fields such as
+// id_token are available through token.Extra.
+func retrieveToken(ctx context.Context, config *authConfig, v url.Values) (*oauth2.Token, error) {
+	client, ok := ctx.Value(oauth2.HTTPClient).(*http.Client)
+	if !ok {
+		client = http.DefaultClient
+	}
+
+	req, err := config.newFormRequest(config.tokenURL(), v)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read token response: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		te := &tokenError{Status: resp.StatusCode}
+		if json.Unmarshal(body, te) != nil || len(te.Code) == 0 {
+			te.Code = resp.Status
+		}
+		return nil, te
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, fmt.Errorf("cannot parse token response: %v", err)
+	}
+	if len(tr.AccessToken) == 0 {
+		return nil, fmt.Errorf("token response did not contain an access_token")
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(body, &raw)
+
+	token := &oauth2.Token{
+		AccessToken:  tr.AccessToken,
+		TokenType:    tr.TokenType,
+		RefreshToken: tr.RefreshToken,
+	}
+	if expiresIn, err := tr.ExpiresIn.Int64(); err == nil && expiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	return token.WithExtra(raw), nil
+}
+
+// exchangeCode trades an authorization code for a token. verifier is the
+// PKCE code_verifier and is omitted when empty.
+func exchangeCode(ctx context.Context, config *authConfig, code string, verifier string) (*oauth2.Token, error) {
+	v := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {config.CallbackURL},
+	}
+	if len(verifier) > 0 {
+		v.Set("code_verifier", verifier)
+	}
+	return retrieveToken(ctx, config, v)
+}